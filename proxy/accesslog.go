@@ -0,0 +1,423 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultAccessLogFormat is the format of access log records unless set with WithAccessLogFormat.
+const DefaultAccessLogFormat = "start_time=%START_TIME% method=%METHOD% authority=%AUTHORITY% peer=%PEER% " +
+	"backend=%BACKEND% group=%GROUP% code=%CODE% error=%ERROR% duration_ms=%DURATION% first_response_ms=%FIRST_RESPONSE% " +
+	"request_messages=%REQUEST_MESSAGES% request_bytes=%REQUEST_BYTES% " +
+	"response_messages=%RESPONSE_MESSAGES% response_bytes=%RESPONSE_BYTES% " +
+	"request_id=%REQUEST_ID% user_agent=%REQ(user-agent)%"
+
+// AccessLog writes a structured record for every call handled with WithAccessLog once it ends, as JSON or logfmt.
+//
+// Records are made of the fields of a format, a space-separated list of key=value pairs. Values are either literals
+// or one of the following commands:
+//
+//	%START_TIME%         the time the proxy started handling the call
+//	%METHOD%             the full method name
+//	%AUTHORITY%          the authority the client called
+//	%PEER%               the address of the client
+//	%BACKEND%            the backend the call was forwarded to, see StreamInfo.Backend
+//	%GROUP%              the group of backends the call was forwarded to, see StreamInfo.Group
+//	%CODE%               the status code returned to the client
+//	%ERROR%              the status message returned to the client
+//	%DURATION%           the duration of the call, in milliseconds
+//	%FIRST_RESPONSE%     the time until the first message of the backend, in milliseconds
+//	%REQUEST_MESSAGES%   the number of messages forwarded from the client to the backend
+//	%REQUEST_BYTES%      the size of the messages forwarded from the client to the backend
+//	%RESPONSE_MESSAGES%  the number of messages forwarded from the backend to the client
+//	%RESPONSE_BYTES%     the size of the messages forwarded from the backend to the client
+//	%REQUEST_ID%         the request ID, see WithRequestIDs, or else the value of the x-request-id metadata key
+//	%REQ(key)%           the first value of a metadata key of the client
+//
+// Fields without a value, such as the backend of a call the director rejected, are left out.
+type AccessLog struct {
+	logger   *slog.Logger
+	fields   []accessLogField
+	sampling []AccessLogSampling
+	closer   io.Closer
+}
+
+// AccessLogSampling sets the share of the calls to the methods it matches, and ending with the codes it matches, that
+// are logged.
+type AccessLogSampling struct {
+	// Method is a pattern matched against the full method name, with the same syntax as TimeoutRule.Method.
+	Method string
+	// Codes are the status codes matched, all of them if empty.
+	Codes []codes.Code
+	// Rate is the share of the matching calls logged, between 0 and 1.
+	Rate float64
+}
+
+func (r *AccessLogSampling) matches(fullMethodName string, code codes.Code) bool {
+	if !matchMethod(r.Method, fullMethodName) {
+		return false
+	}
+	if len(r.Codes) == 0 {
+		return true
+	}
+	for _, c := range r.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLogRecord is what access log fields are taken from.
+type accessLogRecord struct {
+	ctx  context.Context
+	md   metadata.MD
+	info *StreamInfo
+	err  error
+	end  time.Time
+}
+
+type accessLogField struct {
+	key   string
+	value func(r *accessLogRecord) (slog.Value, bool)
+}
+
+type accessLogOptions struct {
+	writer   io.Writer
+	closer   io.Closer
+	logfmt   bool
+	format   string
+	sampling []AccessLogSampling
+	err      error
+}
+
+// AccessLogOption configures an AccessLog.
+type AccessLogOption func(*accessLogOptions)
+
+// WithAccessLogWriter writes records to w, os.Stderr by default.
+func WithAccessLogWriter(w io.Writer) AccessLogOption {
+	return func(o *accessLogOptions) {
+		o.writer = w
+	}
+}
+
+// WithAccessLogFile appends records to the file at path. Once the file reaches maxBytes, it is renamed with the suffix
+// ".1", older files are shifted to ".2" and so on up to maxBackups, and a new file is started. Zero maxBytes disables
+// the rotation. The file is closed by AccessLog.Close.
+func WithAccessLogFile(path string, maxBytes int64, maxBackups int) AccessLogOption {
+	return func(o *accessLogOptions) {
+		f, err := openRotatingFile(path, maxBytes, maxBackups)
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.writer, o.closer = f, f
+	}
+}
+
+// WithAccessLogLogfmt writes records as logfmt instead of JSON.
+func WithAccessLogLogfmt() AccessLogOption {
+	return func(o *accessLogOptions) {
+		o.logfmt = true
+	}
+}
+
+// WithAccessLogFormat sets the format of records, DefaultAccessLogFormat by default.
+func WithAccessLogFormat(format string) AccessLogOption {
+	return func(o *accessLogOptions) {
+		o.format = format
+	}
+}
+
+// WithAccessLogSampling samples the calls logged with the given rules. Rules are evaluated in order and only the first
+// rule matching a call applies. Calls matching no rule are all logged.
+func WithAccessLogSampling(rules ...AccessLogSampling) AccessLogOption {
+	return func(o *accessLogOptions) {
+		o.sampling = append(o.sampling, rules...)
+	}
+}
+
+// NewAccessLog creates an AccessLog.
+func NewAccessLog(opts ...AccessLogOption) (*AccessLog, error) {
+	o := &accessLogOptions{writer: os.Stderr, format: DefaultAccessLogFormat}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	fields, err := parseAccessLogFormat(o.format)
+	if err != nil {
+		if o.closer != nil {
+			o.closer.Close()
+		}
+		return nil, err
+	}
+	var h slog.Handler
+	if o.logfmt {
+		h = slog.NewTextHandler(o.writer, nil)
+	} else {
+		h = slog.NewJSONHandler(o.writer, nil)
+	}
+	return &AccessLog{logger: slog.New(h), fields: fields, sampling: o.sampling, closer: o.closer}, nil
+}
+
+// WithAccessLog makes the handler log the calls it handles with a.
+func WithAccessLog(a *AccessLog) HandlerOption {
+	return func(o *handlerOptions) {
+		o.accessLog = a
+	}
+}
+
+// Close closes the file records are written to, if any.
+func (a *AccessLog) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+func parseAccessLogFormat(format string) ([]accessLogField, error) {
+	var fields []accessLogField
+	for _, pair := range strings.Fields(format) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("proxy: access log field %q is not a key=value pair", pair)
+		}
+		f := accessLogField{key: key}
+		if strings.HasPrefix(value, "%") && strings.HasSuffix(value, "%") && len(value) > 1 {
+			var err error
+			if f.value, err = accessLogCommand(strings.Trim(value, "%")); err != nil {
+				return nil, err
+			}
+		} else {
+			literal := slog.StringValue(value)
+			f.value = func(*accessLogRecord) (slog.Value, bool) { return literal, true }
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func stringField(s string) (slog.Value, bool) {
+	return slog.StringValue(s), s != ""
+}
+
+func millis(d time.Duration) slog.Value {
+	return slog.Float64Value(float64(d) / float64(time.Millisecond))
+}
+
+func metadataField(md metadata.MD, key string) (slog.Value, bool) {
+	if vals := md.Get(key); len(vals) > 0 {
+		return slog.StringValue(vals[0]), true
+	}
+	return slog.Value{}, false
+}
+
+func accessLogCommand(cmd string) (func(r *accessLogRecord) (slog.Value, bool), error) {
+	if strings.HasPrefix(cmd, "REQ(") && strings.HasSuffix(cmd, ")") {
+		key := strings.ToLower(cmd[len("REQ(") : len(cmd)-1])
+		return func(r *accessLogRecord) (slog.Value, bool) { return metadataField(r.md, key) }, nil
+	}
+	messages := func(d FrameDirection, bytes bool) func(r *accessLogRecord) (slog.Value, bool) {
+		return func(r *accessLogRecord) (slog.Value, bool) {
+			count, size := r.info.Messages(d)
+			if bytes {
+				return slog.Int64Value(size), true
+			}
+			return slog.Int64Value(count), true
+		}
+	}
+	switch cmd {
+	case "START_TIME":
+		return func(r *accessLogRecord) (slog.Value, bool) { return slog.TimeValue(r.info.StartTime), true }, nil
+	case "METHOD":
+		return func(r *accessLogRecord) (slog.Value, bool) { return stringField(r.info.FullMethod) }, nil
+	case "AUTHORITY":
+		return func(r *accessLogRecord) (slog.Value, bool) { return metadataField(r.md, ":authority") }, nil
+	case "PEER":
+		return func(r *accessLogRecord) (slog.Value, bool) {
+			if p, ok := peer.FromContext(r.ctx); ok && p.Addr != nil {
+				return slog.StringValue(p.Addr.String()), true
+			}
+			return slog.Value{}, false
+		}, nil
+	case "BACKEND":
+		return func(r *accessLogRecord) (slog.Value, bool) { return stringField(r.info.Backend()) }, nil
+	case "GROUP":
+		return func(r *accessLogRecord) (slog.Value, bool) { return stringField(r.info.Group()) }, nil
+	case "CODE":
+		return func(r *accessLogRecord) (slog.Value, bool) {
+			return slog.StringValue(status.Code(r.err).String()), true
+		}, nil
+	case "ERROR":
+		return func(r *accessLogRecord) (slog.Value, bool) {
+			if r.err == nil {
+				return slog.Value{}, false
+			}
+			return stringField(status.Convert(r.err).Message())
+		}, nil
+	case "DURATION":
+		return func(r *accessLogRecord) (slog.Value, bool) { return millis(r.end.Sub(r.info.StartTime)), true }, nil
+	case "FIRST_RESPONSE":
+		return func(r *accessLogRecord) (slog.Value, bool) {
+			t := r.info.FirstResponse()
+			return millis(t.Sub(r.info.StartTime)), !t.IsZero()
+		}, nil
+	case "REQUEST_MESSAGES":
+		return messages(ClientToBackend, false), nil
+	case "REQUEST_BYTES":
+		return messages(ClientToBackend, true), nil
+	case "RESPONSE_MESSAGES":
+		return messages(BackendToClient, false), nil
+	case "RESPONSE_BYTES":
+		return messages(BackendToClient, true), nil
+	case "REQUEST_ID":
+		return func(r *accessLogRecord) (slog.Value, bool) {
+			if id, ok := RequestIDFromContext(r.ctx); ok {
+				return slog.StringValue(id), true
+			}
+			return metadataField(r.md, RequestIDKey)
+		}, nil
+	}
+	return nil, fmt.Errorf("proxy: unknown access log command %%%s%%", cmd)
+}
+
+func (a *AccessLog) sampled(fullMethodName string, err error) bool {
+	code := status.Code(err)
+	for i := range a.sampling {
+		if a.sampling[i].matches(fullMethodName, code) {
+			return rand.Float64() < a.sampling[i].Rate
+		}
+	}
+	return true
+}
+
+// observe logs the call described by info once it is done. The ctx is the context of the call.
+func (a *AccessLog) observe(ctx context.Context, info *StreamInfo) {
+	info.OnDone(func(err error) {
+		if !a.sampled(info.FullMethod, err) {
+			return
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		r := &accessLogRecord{ctx: ctx, md: md, info: info, err: err, end: time.Now()}
+		attrs := make([]slog.Attr, 0, len(a.fields))
+		for _, f := range a.fields {
+			if v, ok := f.value(r); ok {
+				attrs = append(attrs, slog.Attr{Key: f.key, Value: v})
+			}
+		}
+		a.logger.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+	})
+}
+
+// rotatingFile is a file that is rotated once it reaches a maximum size.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu sync.Mutex
+	// f is nil once the file is closed, or if it could not be opened again after a rotation.
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		// A failed rotation keeps writing to the file if it is still open, and is attempted again by the next write.
+		if err := r.rotate(); err != nil && r.f == nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to its first backup and starts a new one. The file at path is opened again even if moving it
+// failed, so that records are not lost.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err == nil {
+		err = r.shift()
+	}
+	if openErr := r.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// shift moves the file and its backups to the next backup, or removes the file if there are no backups.
+func (r *rotatingFile) shift() error {
+	if r.maxBackups == 0 {
+		return os.Remove(r.path)
+	}
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.path+".1")
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,174 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// bytes returns a copy of what was written so far.
+func (b *syncBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines
+}
+
+// accessLogTo returns the option logging calls to an AccessLog created with opts.
+func accessLogTo(t *testing.T, opts ...proxy.AccessLogOption) proxy.HandlerOption {
+	t.Helper()
+	accessLog, err := proxy.NewAccessLog(opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { accessLog.Close() })
+	return proxy.WithAccessLog(accessLog)
+}
+
+func TestAccessLog_JSON(t *testing.T) {
+	out := &syncBuffer{}
+	client := balancedTestClient(t, nil, accessLogTo(t, proxy.WithAccessLogWriter(out)))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "req-1")
+	_, err := client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	_, err = client.PingError(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.Error(t, err)
+
+	lines := out.lines()
+	require.Len(t, lines, 2)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "access", record["msg"])
+	assert.Equal(t, "/mwitkow.testproto.TestService/Ping", record["method"])
+	assert.Equal(t, "backend", record["backend"])
+	assert.Equal(t, "OK", record["code"])
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, "bufnet", record["authority"])
+	assert.EqualValues(t, 1, record["request_messages"])
+	assert.EqualValues(t, 7, record["request_bytes"])
+	assert.EqualValues(t, 1, record["response_messages"])
+	assert.Contains(t, record["user_agent"], "grpc-go")
+	assert.Contains(t, record, "duration_ms")
+	assert.Contains(t, record, "first_response_ms")
+	assert.Contains(t, record, "peer")
+	assert.NotContains(t, record, "error")
+	assert.NotContains(t, record, "group")
+
+	record = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "Unknown", record["code"])
+	assert.Equal(t, "Something is wrong and this is a message that describes it", record["error"])
+}
+
+func TestAccessLog_LogfmtFormat(t *testing.T) {
+	out := &syncBuffer{}
+	client := proxyTestClient(t, nil, accessLogTo(t, proxy.WithAccessLogWriter(out), proxy.WithAccessLogLogfmt(),
+		proxy.WithAccessLogFormat("kind=proxy method=%METHOD% code=%CODE% tenant=%REQ(X-Tenant)%")))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "acme")
+	_, err := client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+
+	lines := out.lines()
+	require.Len(t, lines, 1)
+	assert.Regexp(t, `^time=\S+ level=INFO msg=access kind=proxy method=/mwitkow.testproto.TestService/Ping code=OK tenant=acme$`, lines[0])
+}
+
+func TestAccessLog_Sampling(t *testing.T) {
+	out := &syncBuffer{}
+	client := proxyTestClient(t, nil, accessLogTo(t, proxy.WithAccessLogWriter(out), proxy.WithAccessLogFormat("method=%METHOD% code=%CODE%"),
+		proxy.WithAccessLogSampling(proxy.AccessLogSampling{Method: "/mwitkow.testproto.TestService/*", Codes: []codes.Code{codes.OK}, Rate: 0})))
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+		require.NoError(t, err)
+	}
+	_, err := client.PingError(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.Error(t, err)
+
+	lines := out.lines()
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"method":"/mwitkow.testproto.TestService/PingError","code":"Unknown"`)
+}
+
+func TestAccessLog_FileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	client := proxyTestClient(t, nil, accessLogTo(t, proxy.WithAccessLogFile(path, 10, 1), proxy.WithAccessLogFormat("method=%METHOD%")))
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+		require.NoError(t, err)
+	}
+
+	for _, name := range []string{path, path + ".1"} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(string(data), "\n"), name)
+	}
+	_, err := os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAccessLog_FailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	client := proxyTestClient(t, nil, accessLogTo(t, proxy.WithAccessLogFile(path, 10, 1), proxy.WithAccessLogFormat("method=%METHOD%")))
+	// A non-empty directory in the way of the backup makes the rotation fail.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o755))
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+		require.NoError(t, err)
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"), "records must be kept while the file cannot be rotated")
+
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"), "the rotation must be attempted again")
+}
+
+func TestNewAccessLog_InvalidFormat(t *testing.T) {
+	for _, format := range []string{"method", "method=%UNKNOWN%", "=%METHOD%"} {
+		_, err := proxy.NewAccessLog(proxy.WithAccessLogFormat(format))
+		assert.Error(t, err, format)
+	}
+}
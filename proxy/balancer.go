@@ -0,0 +1,297 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// BalancingPolicy selects how a Balancer spreads calls across its backends.
+type BalancingPolicy string
+
+const (
+	// RoundRobin picks backends in turn.
+	RoundRobin BalancingPolicy = "round_robin"
+	// LeastOutstanding picks the backend with the fewest calls in flight.
+	LeastOutstanding BalancingPolicy = "least_outstanding"
+	// RandomTwoChoices picks two backends at random and uses the one with fewer calls in flight.
+	RandomTwoChoices BalancingPolicy = "random_two_choices"
+	// ConsistentHash picks backends by hashing the value of a metadata key onto a ring of backends, so that calls
+	// carrying the same value land on the same backend. Calls without the key are balanced round-robin.
+	ConsistentHash BalancingPolicy = "consistent_hash"
+)
+
+// ringReplicas is the number of points each backend occupies on a consistent hashing ring.
+const ringReplicas = 160
+
+// Balancer spreads proxied calls across a set of named backends.
+//
+// The calls in flight on each backend are tracked through the lifecycle of the calls in the proxy handler, so a
+// Balancer must be used with the context of a proxied call, as received by a StreamDirector.
+type Balancer struct {
+	policy   BalancingPolicy
+	hashKey  string
+	healthy  func(backend string) bool
+	service  func(backend, service string) bool
+	backends []string
+	inflight []atomic.Int64
+	next     atomic.Uint64
+	ring     *hashRing
+}
+
+// BalancerOption configures a Balancer.
+type BalancerOption func(*Balancer)
+
+// WithHashKey sets the metadata key whose value is hashed by the ConsistentHash policy.
+func WithHashKey(key string) BalancerOption {
+	return func(b *Balancer) {
+		b.hashKey = key
+	}
+}
+
+// WithBalancerHealth sets the function reporting whether a backend is healthy, such as OutlierDetector.Healthy.
+// Unhealthy backends are skipped by all policies; with ConsistentHash their keys go to the next backend on the ring.
+func WithBalancerHealth(healthy func(backend string) bool) BalancerOption {
+	return func(b *Balancer) {
+		b.healthy = healthy
+	}
+}
+
+// WithBalancerServiceHealth sets the function reporting whether a backend is healthy for a service, such as
+// HealthChecker.ServiceHealthy. Backends unhealthy for the service of a call, e.g. "package.Service", are skipped as
+// with WithBalancerHealth. The service is empty if the call is unknown.
+func WithBalancerServiceHealth(healthy func(backend, service string) bool) BalancerOption {
+	return func(b *Balancer) {
+		b.service = healthy
+	}
+}
+
+// NewBalancer creates a Balancer spreading calls across the named backends according to policy.
+func NewBalancer(policy BalancingPolicy, backends []string, opts ...BalancerOption) (*Balancer, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("proxy: balancer needs at least one backend")
+	}
+	b := &Balancer{
+		policy:   policy,
+		backends: append([]string(nil), backends...),
+		inflight: make([]atomic.Int64, len(backends)),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	switch policy {
+	case RoundRobin, LeastOutstanding, RandomTwoChoices:
+	case ConsistentHash:
+		if b.hashKey == "" {
+			return nil, fmt.Errorf("proxy: %s balancing needs a hash key", policy)
+		}
+		b.ring = newHashRing(b.backends)
+	default:
+		return nil, fmt.Errorf("proxy: unknown balancing policy %q", policy)
+	}
+	return b, nil
+}
+
+// Pick chooses the backend for the call in ctx and counts the call as in flight on it until the attempt it is picked
+// for is done. The backend is recorded in the StreamInfo of the call. If no backend is healthy, an Unavailable error
+// is returned.
+//
+// Retries of a call, see WithRetries, avoid the backends of its previous attempts.
+func (b *Balancer) Pick(ctx context.Context) (string, error) {
+	return b.pickFor(ctx, callService(ctx))
+}
+
+// pickFor is like Pick, for a call to service.
+func (b *Balancer) pickFor(ctx context.Context, service string) (string, error) {
+	usable := func(i int) bool { return b.usable(i, service) }
+	i := -1
+	if info, ok := StreamInfoFromContext(ctx); ok && info.Attempt() > 0 {
+		// Retries go to other backends than the previous attempts, if there are healthy ones.
+		previous := info.PreviousBackends()
+		i = b.pick(ctx, func(i int) bool { return usable(i) && !containsString(previous, b.backends[i]) })
+	}
+	if i < 0 {
+		i = b.pick(ctx, usable)
+	}
+	if i < 0 {
+		return "", status.Errorf(codes.Unavailable, "proxy: no healthy backend available")
+	}
+	b.inflight[i].Add(1)
+	release := func() { b.inflight[i].Add(-1) }
+	if info, ok := StreamInfoFromContext(ctx); ok {
+		info.SetBackend(b.backends[i])
+		info.onAttemptDone(func(error) { release() })
+	} else {
+		context.AfterFunc(ctx, release)
+	}
+	return b.backends[i], nil
+}
+
+// pick returns the index of the backend for the call in ctx among the ones usable reports true for, or -1 if there is
+// none.
+func (b *Balancer) pick(ctx context.Context, usable func(i int) bool) int {
+	n := len(b.backends)
+	switch b.policy {
+	case LeastOutstanding:
+		start := int(b.next.Add(1) % uint64(n))
+		best := -1
+		for j := 0; j < n; j++ {
+			if i := (start + j) % n; usable(i) && (best < 0 || b.inflight[i].Load() < b.inflight[best].Load()) {
+				best = i
+			}
+		}
+		return best
+	case RandomTwoChoices:
+		candidates := make([]int, 0, n)
+		for i := 0; i < n; i++ {
+			if usable(i) {
+				candidates = append(candidates, i)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			return -1
+		case 1:
+			return candidates[0]
+		}
+		i, j := rand.Intn(len(candidates)), rand.Intn(len(candidates)-1)
+		if j >= i {
+			j++
+		}
+		if i, j = candidates[i], candidates[j]; b.inflight[j].Load() < b.inflight[i].Load() {
+			return j
+		}
+		return i
+	case ConsistentHash:
+		md, _ := metadata.FromIncomingContext(ctx)
+		if vals := md.Get(b.hashKey); len(vals) > 0 {
+			picked := -1
+			b.ring.walk(vals[0], func(owner int) bool {
+				if usable(owner) {
+					picked = owner
+					return false
+				}
+				return true
+			})
+			return picked
+		}
+	}
+	start := int(b.next.Add(1) % uint64(n))
+	for j := 0; j < n; j++ {
+		if i := (start + j) % n; usable(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Balancer) usable(i int, service string) bool {
+	return (b.healthy == nil || b.healthy(b.backends[i])) && (b.service == nil || b.service(b.backends[i], service))
+}
+
+// Outstanding returns the number of calls in flight on the named backend.
+func (b *Balancer) Outstanding(backend string) int64 {
+	for i, name := range b.backends {
+		if name == backend {
+			return b.inflight[i].Load()
+		}
+	}
+	return 0
+}
+
+// BalancingDirector returns a StreamDirector forwarding each call to the connection of the backend picked by b.
+// The inbound metadata is forwarded, as with DefaultDirector.
+func BalancingDirector(b *Balancer, conns map[string]grpc.ClientConnInterface) StreamDirector {
+	return func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		backend, err := b.Pick(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		cc, ok := conns[backend]
+		if !ok {
+			return nil, nil, status.Errorf(codes.Internal, "proxy: no connection to backend %q", backend)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		return metadata.NewOutgoingContext(ctx, md.Copy()), cc, nil
+	}
+}
+
+// hashRing maps keys onto backends, such that adding or removing a backend only moves the keys of that backend.
+type hashRing struct {
+	points []uint32
+	owners []int
+}
+
+func newHashRing(backends []string) *hashRing {
+	type point struct {
+		hash  uint32
+		owner int
+	}
+	points := make([]point, 0, len(backends)*ringReplicas)
+	for i, name := range backends {
+		for r := 0; r < ringReplicas; r++ {
+			points = append(points, point{hash: hashString(name + "#" + strconv.Itoa(r)), owner: i})
+		}
+	}
+	sort.Slice(points, func(a, b int) bool { return points[a].hash < points[b].hash })
+	ring := &hashRing{points: make([]uint32, len(points)), owners: make([]int, len(points))}
+	for i, p := range points {
+		ring.points[i], ring.owners[i] = p.hash, p.owner
+	}
+	return ring
+}
+
+// search returns the position of the first point on the ring at or after the hash of key.
+func (r *hashRing) search(key string) int {
+	h := hashString(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// walk calls f with the distinct backends on the ring, in order starting with the owner of key, until f returns
+// false.
+func (r *hashRing) walk(key string, f func(owner int) bool) {
+	if len(r.points) == 0 {
+		return
+	}
+	seen := make(map[int]bool)
+	start := r.search(key)
+	for j := 0; j < len(r.points); j++ {
+		owner := r.owners[(start+j)%len(r.points)]
+		if seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		if !f(owner) {
+			return
+		}
+	}
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	// FNV spreads similar short strings poorly, so the result is mixed with the murmur3 finalizer.
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,148 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// balancedTestClient is like proxyTestClient, but calls are balanced onto svc as the backend named "backend", so that
+// the handler sees which backend serves them.
+func balancedTestClient(t *testing.T, svc testservice.TestServiceServer, opts ...proxy.HandlerOption) testservice.TestServiceClient {
+	t.Helper()
+
+	b, err := proxy.NewBalancer(proxy.RoundRobin, []string{"backend"})
+	require.NoError(t, err)
+	conns := map[string]grpc.ClientConnInterface{"backend": testBackendConn(t, svc)}
+	return directedTestClient(t, proxy.BalancingDirector(b, conns), opts...)
+}
+
+func pickN(t *testing.T, b *proxy.Balancer, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		backend, err := b.Pick(ctx)
+		require.NoError(t, err)
+		counts[backend]++
+		before := b.Outstanding(backend) - 1
+		cancel()
+		// Calls outside of the proxy handler are released asynchronously.
+		require.Eventually(t, func() bool { return b.Outstanding(backend) == before }, time.Second, time.Millisecond)
+	}
+	return counts
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b, err := proxy.NewBalancer(proxy.RoundRobin, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 10, "b": 10, "c": 10}, pickN(t, b, 30))
+}
+
+func TestBalancer_LeastOutstanding(t *testing.T) {
+	for _, policy := range []proxy.BalancingPolicy{proxy.LeastOutstanding, proxy.RandomTwoChoices} {
+		t.Run(string(policy), func(t *testing.T) {
+			b, err := proxy.NewBalancer(policy, []string{"a", "b"})
+			require.NoError(t, err)
+
+			// Keep a number of calls in flight on whichever backend gets them first.
+			ctx, cancel := context.WithCancel(context.Background())
+			first, err := b.Pick(ctx)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, b.Outstanding(first))
+
+			other := map[string]string{"a": "b", "b": "a"}[first]
+			assert.Equal(t, map[string]int{other: 10}, pickN(t, b, 10), "calls must avoid the busy backend")
+
+			cancel()
+			require.Eventually(t, func() bool { return b.Outstanding(first) == 0 }, time.Second, time.Millisecond)
+		})
+	}
+}
+
+func TestBalancer_ConsistentHash(t *testing.T) {
+	backends := []string{"a", "b", "c", "d"}
+	full, err := proxy.NewBalancer(proxy.ConsistentHash, backends, proxy.WithHashKey("x-user"))
+	require.NoError(t, err)
+	shrunk, err := proxy.NewBalancer(proxy.ConsistentHash, backends[:3], proxy.WithHashKey("x-user"))
+	require.NoError(t, err)
+
+	pick := func(b *proxy.Balancer, user string) string {
+		ctx, cancel := context.WithCancel(metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user", user)))
+		defer cancel()
+		backend, err := b.Pick(ctx)
+		require.NoError(t, err)
+		return backend
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		backend := pick(full, user)
+		counts[backend]++
+		assert.Equal(t, backend, pick(full, user), "the same key must land on the same backend")
+		if backend != "d" {
+			assert.Equal(t, backend, pick(shrunk, user), "removing a backend must only move its own keys")
+		}
+	}
+	for _, backend := range backends {
+		assert.InDelta(t, 250, counts[backend], 100, "keys must be spread evenly, got %v", counts)
+	}
+
+	_, err = proxy.NewBalancer(proxy.ConsistentHash, backends)
+	assert.Error(t, err, "consistent hashing needs a key")
+	_, err = proxy.NewBalancer("fastest", backends)
+	assert.Error(t, err)
+	_, err = proxy.NewBalancer(proxy.RoundRobin, nil)
+	assert.Error(t, err)
+}
+
+func TestRouter_Balancing(t *testing.T) {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "a", "b")...))
+	defer pool.Close()
+	cfg, err := proxy.ParseRouterConfig([]byte(`
+backends:
+  a: {target: a}
+  b: {target: b}
+routes:
+  - backends: [a, b]
+    balancing: least_outstanding
+`))
+	require.NoError(t, err)
+	router, err := proxy.NewRouter(cfg, pool)
+	require.NoError(t, err)
+
+	var picked []string
+	director := func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		outCtx, cc, err := router.Director(ctx, fullMethodName)
+		info, _ := proxy.StreamInfoFromContext(ctx)
+		picked = append(picked, info.Backend())
+		return outCtx, cc, err
+	}
+	client := directedTestClient(t, director)
+
+	stream, err := client.PingStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "hello"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
+	require.Len(t, picked, 4)
+	for _, backend := range picked[1:] {
+		assert.NotEqual(t, picked[0], backend, "unary calls must avoid the backend busy with the stream")
+	}
+}
@@ -0,0 +1,760 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Capture records proxied calls frame by frame, to see exactly what went through the proxy when debugging. Calls are
+// picked by sampling, or flagged by their client with a metadata key.
+//
+// Every captured call is written as a session once it ends: the method, peer, backend and status of the call, the
+// metadata of the client, the headers and trailers sent to it, and every message with its direction and the time it
+// went through the proxy. Messages are recorded as received from the client and as sent to it, that is before the
+// FrameInterceptors for requests and after them for responses.
+//
+// Sessions are written as protobuf-encoded records, each prefixed with its varint-encoded length, and are read back
+// with CaptureReader. They are held in memory until the call ends, within the limits set with WithCaptureLimits.
+type Capture struct {
+	captureOptions
+	mu sync.Mutex
+}
+
+// CaptureRedactor returns what is recorded of a message that went through the proxy, e.g. the payload with sensitive
+// fields cleared. Returning nil leaves the payload out of the capture, see CapturedFrame.Redacted. Redactors run once
+// the call ended, on whole messages, as they are only cut at the frame limit afterwards.
+type CaptureRedactor func(ctx context.Context, info *FrameInfo, payload []byte) []byte
+
+type captureRule struct {
+	method  string
+	percent float64
+}
+
+type captureOptions struct {
+	writer       io.Writer
+	closer       io.Closer
+	rules        []captureRule
+	header       string
+	frameLimit   int
+	sessionLimit int
+	redactedKeys map[string]bool
+	redactors    []CaptureRedactor
+	onError      func(error)
+	err          error
+}
+
+// CaptureOption configures a Capture.
+type CaptureOption func(*captureOptions)
+
+// WithCaptureWriter writes sessions to w.
+func WithCaptureWriter(w io.Writer) CaptureOption {
+	return func(o *captureOptions) {
+		o.writer = w
+	}
+}
+
+// WithCaptureFile appends sessions to the file at path, rotated like the file set with WithAccessLogFile. Sessions are
+// never split across files. The file is closed by Capture.Close.
+func WithCaptureFile(path string, maxBytes int64, maxBackups int) CaptureOption {
+	return func(o *captureOptions) {
+		f, err := openRotatingFile(path, maxBytes, maxBackups)
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.writer, o.closer = f, f
+	}
+}
+
+// WithCaptureSampling captures the given percentage, between 0 and 100, of the calls to the methods matching method,
+// with the same syntax as TimeoutRule.Method. Rules are evaluated in order and only the first rule matching a method
+// applies. Methods matching no rule are not sampled. Without rules nor WithCaptureHeader, all calls are captured.
+func WithCaptureSampling(method string, percent float64) CaptureOption {
+	return func(o *captureOptions) {
+		o.rules = append(o.rules, captureRule{method: method, percent: percent})
+	}
+}
+
+// WithCaptureHeader captures all the calls whose client sets the metadata key, with any value.
+func WithCaptureHeader(key string) CaptureOption {
+	return func(o *captureOptions) {
+		o.header = strings.ToLower(key)
+	}
+}
+
+// WithCaptureLimits sets the number of bytes recorded of every message, 64 KiB by default, beyond which messages are
+// truncated, and of every session, 1 MiB by default, beyond which no more messages of the call are recorded.
+func WithCaptureLimits(frameBytes, sessionBytes int) CaptureOption {
+	return func(o *captureOptions) {
+		o.frameLimit = frameBytes
+		o.sessionLimit = sessionBytes
+	}
+}
+
+// WithCaptureRedactedMetadata replaces the values of the given metadata keys with "REDACTED" in the metadata, headers
+// and trailers recorded. The authorization and cookie keys are always redacted.
+func WithCaptureRedactedMetadata(keys ...string) CaptureOption {
+	return func(o *captureOptions) {
+		for _, k := range keys {
+			o.redactedKeys[strings.ToLower(k)] = true
+		}
+	}
+}
+
+// WithCaptureRedactors adds CaptureRedactors applied to every message recorded. They are executed in the order
+// given, each one receiving the payload returned by the previous one.
+func WithCaptureRedactors(redactors ...CaptureRedactor) CaptureOption {
+	return func(o *captureOptions) {
+		o.redactors = append(o.redactors, redactors...)
+	}
+}
+
+// WithCaptureErrorCallback sets a function called with the error of every session that could not be written. Such
+// sessions are otherwise lost silently. It may be called concurrently.
+func WithCaptureErrorCallback(f func(error)) CaptureOption {
+	return func(o *captureOptions) {
+		o.onError = f
+	}
+}
+
+// NewCapture creates a Capture writing sessions to the writer or file set with WithCaptureWriter or WithCaptureFile.
+func NewCapture(opts ...CaptureOption) (*Capture, error) {
+	c := &Capture{captureOptions: captureOptions{
+		frameLimit:   64 << 10,
+		sessionLimit: 1 << 20,
+		redactedKeys: map[string]bool{"authorization": true, "cookie": true},
+	}}
+	for _, opt := range opts {
+		opt(&c.captureOptions)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.writer == nil {
+		return nil, errors.New("proxy: capture needs a writer or a file")
+	}
+	return c, nil
+}
+
+// WithCapture makes the handler capture calls with c.
+func WithCapture(c *Capture) HandlerOption {
+	return func(o *handlerOptions) {
+		o.capture = c
+	}
+}
+
+// Close closes the file sessions are written to, if any.
+func (c *Capture) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// RedactMessageFields returns a CaptureRedactor clearing the given fields, e.g. "mypackage.User.password", wherever
+// they appear in messages, including nested ones. Messages are decoded with the descriptors found by resolver, and
+// left out of the capture if they cannot be.
+func RedactMessageFields(resolver DescriptorResolver, fields ...string) CaptureRedactor {
+	redacted := make(map[protoreflect.FullName]bool)
+	for _, f := range fields {
+		redacted[protoreflect.FullName(f)] = true
+	}
+	return func(ctx context.Context, info *FrameInfo, payload []byte) []byte {
+		md, err := resolver.ResolveMethod(ctx, info.FullMethod)
+		if err != nil {
+			return nil
+		}
+		desc := md.Input()
+		if info.Direction == BackendToClient {
+			desc = md.Output()
+		}
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil
+		}
+		clearFields(msg, redacted)
+		out, err := proto.Marshal(msg)
+		if err != nil {
+			return nil
+		}
+		return out
+	}
+}
+
+// clearFields clears the given fields of m and of all the messages nested in it.
+func clearFields(m protoreflect.Message, fields map[protoreflect.FullName]bool) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fields[fd.FullName()]:
+			m.Clear(fd)
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					clearFields(mv.Message(), fields)
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				for i, l := 0, v.List(); i < l.Len(); i++ {
+					clearFields(l.Get(i).Message(), fields)
+				}
+			}
+		case fd.Message() != nil:
+			clearFields(v.Message(), fields)
+		}
+		return true
+	})
+}
+
+func (c *Capture) sampled(fullMethodName string, md metadata.MD) bool {
+	if c.header != "" && len(md.Get(c.header)) > 0 {
+		return true
+	}
+	if len(c.rules) == 0 {
+		return c.header == ""
+	}
+	for _, r := range c.rules {
+		if matchMethod(r.method, fullMethodName) {
+			return rand.Float64()*100 < r.percent
+		}
+	}
+	return false
+}
+
+func (c *Capture) redact(md metadata.MD) metadata.MD {
+	md = md.Copy()
+	for k, vals := range md {
+		if c.redactedKeys[k] {
+			for i := range vals {
+				vals[i] = "REDACTED"
+			}
+		}
+	}
+	return md
+}
+
+// start starts capturing the call described by info if it is sampled, and returns the stream the call is to be
+// proxied with. The ctx is the context of the call.
+func (c *Capture) start(ctx context.Context, serverStream grpc.ServerStream, info *StreamInfo) grpc.ServerStream {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !c.sampled(info.FullMethod, md) {
+		return serverStream
+	}
+	call := &captureCall{
+		c:   c,
+		ctx: ctx,
+		session: CapturedSession{
+			FullMethod: info.FullMethod,
+			Start:      info.StartTime,
+			Metadata:   c.redact(md),
+		},
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		call.session.Peer = p.Addr.String()
+	}
+	info.OnDone(func(err error) {
+		call.finish(info, err)
+	})
+	return &capturedStream{ServerStream: serverStream, call: call}
+}
+
+// captureFrameOverhead is accounted for every message recorded on top of its payload, so that streams of small
+// messages are bounded by the session limit too.
+const captureFrameOverhead = 32
+
+// captureCall is a call being captured.
+type captureCall struct {
+	c   *Capture
+	ctx context.Context
+
+	mu      sync.Mutex
+	session CapturedSession
+	size    int
+}
+
+func (c *captureCall) recordFrame(d FrameDirection, payload []byte) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session.Truncated {
+		return
+	}
+	f := CapturedFrame{Direction: d, Time: now, Size: len(payload)}
+	// Messages to be redacted are kept whole until the call ends, and count against the session limit as such.
+	if len(c.c.redactors) == 0 && len(payload) > c.c.frameLimit {
+		payload = payload[:c.c.frameLimit]
+		f.Truncated = true
+	}
+	if c.size += len(payload) + captureFrameOverhead; c.size > c.c.sessionLimit {
+		c.session.Truncated = true
+		return
+	}
+	f.Payload = append([]byte{}, payload...)
+	c.session.Frames = append(c.session.Frames, f)
+}
+
+// redactFrames runs the CaptureRedactors on the recorded messages, and cuts them at the frame limit.
+func (c *captureCall) redactFrames(frames []CapturedFrame) {
+	if len(c.c.redactors) == 0 {
+		return
+	}
+	// The call is over, but its messages are redacted all the same.
+	ctx := context.WithoutCancel(c.ctx)
+	var index [2]int
+	for i := range frames {
+		f := &frames[i]
+		info := &FrameInfo{FullMethod: c.session.FullMethod, Direction: f.Direction, Index: index[f.Direction]}
+		index[f.Direction]++
+		for _, r := range c.c.redactors {
+			if f.Payload = r(ctx, info, f.Payload); f.Payload == nil {
+				f.Redacted = true
+				break
+			}
+		}
+		if len(f.Payload) > c.c.frameLimit {
+			f.Payload = f.Payload[:c.c.frameLimit]
+			f.Truncated = true
+		}
+	}
+}
+
+func (c *captureCall) recordHeader(md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session.Header = metadata.Join(c.session.Header, md)
+}
+
+func (c *captureCall) recordTrailer(md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session.Trailer = metadata.Join(c.session.Trailer, md)
+}
+
+// finish writes the session of the call once it is done.
+func (c *captureCall) finish(info *StreamInfo, err error) {
+	c.mu.Lock()
+	s := c.session
+	s.Frames = append([]CapturedFrame(nil), s.Frames...)
+	c.mu.Unlock()
+	c.redactFrames(s.Frames)
+	s.End = time.Now()
+	s.Backend, s.Group = info.Backend(), info.Group()
+	st := status.Convert(err)
+	s.Code, s.Message = st.Code(), st.Message()
+	s.Header, s.Trailer = c.c.redact(s.Header), c.c.redact(s.Trailer)
+
+	record := s.marshal()
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(record)), uint64(len(record)))
+	b = append(b, record...)
+	c.c.mu.Lock()
+	// A single write keeps the session in one piece, even across the rotation of the file.
+	_, err = c.c.writer.Write(b)
+	c.c.mu.Unlock()
+	if err != nil && c.c.onError != nil {
+		c.c.onError(fmt.Errorf("proxy: writing capture of %s: %w", s.FullMethod, err))
+	}
+}
+
+// capturedStream is the grpc.ServerStream a captured call is proxied with.
+type capturedStream struct {
+	grpc.ServerStream
+	call *captureCall
+}
+
+func (s *capturedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.call.recordFrame(ClientToBackend, m.(proto.Message).ProtoReflect().GetUnknown())
+	}
+	return err
+}
+
+func (s *capturedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.call.recordFrame(BackendToClient, m.(proto.Message).ProtoReflect().GetUnknown())
+	}
+	return err
+}
+
+func (s *capturedStream) SetHeader(md metadata.MD) error {
+	err := s.ServerStream.SetHeader(md)
+	if err == nil {
+		s.call.recordHeader(md)
+	}
+	return err
+}
+
+func (s *capturedStream) SendHeader(md metadata.MD) error {
+	err := s.ServerStream.SendHeader(md)
+	if err == nil {
+		s.call.recordHeader(md)
+	}
+	return err
+}
+
+func (s *capturedStream) SetTrailer(md metadata.MD) {
+	s.ServerStream.SetTrailer(md)
+	s.call.recordTrailer(md)
+}
+
+// CapturedSession is a call recorded by a Capture.
+type CapturedSession struct {
+	FullMethod string
+	// Peer is the address of the client.
+	Peer string
+	// Backend and Group are the ones the call was forwarded to, see StreamInfo.
+	Backend, Group string
+	Start, End     time.Time
+	// Code and Message are the status returned to the client.
+	Code    codes.Code
+	Message string
+	// Metadata is the metadata of the client, Header and Trailer the ones sent to it. A request ID the proxy generated,
+	// see WithRequestIDs, is only found in Header.
+	Metadata, Header, Trailer metadata.MD
+	Frames                    []CapturedFrame
+	// Truncated reports that the call went over the session limit, so that only its first messages were recorded.
+	Truncated bool
+}
+
+// CapturedFrame is a message recorded by a Capture.
+type CapturedFrame struct {
+	Direction FrameDirection
+	Time      time.Time
+	// Payload is the recorded message, empty for empty messages.
+	Payload []byte
+	// Size is the size of the message as forwarded, before redaction.
+	Size int
+	// Truncated reports that the message went over the frame limit, so that Payload is only its beginning.
+	Truncated bool
+	// Redacted reports that a CaptureRedactor left the message out, so that Payload is nil.
+	Redacted bool
+}
+
+// DecodeFrames decodes the messages of the session as the input or output type of its method, depending on their
+// direction. The descriptors are found by resolver, e.g. one created with NewDescriptorSetFileResolver. Messages left
+// out or truncated are decoded as nil.
+func (s *CapturedSession) DecodeFrames(ctx context.Context, resolver DescriptorResolver) ([]protoreflect.Message, error) {
+	md, err := resolver.ResolveMethod(ctx, s.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]protoreflect.Message, len(s.Frames))
+	for i, f := range s.Frames {
+		if f.Redacted || f.Truncated {
+			continue
+		}
+		desc := md.Input()
+		if f.Direction == BackendToClient {
+			desc = md.Output()
+		}
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(f.Payload, msg); err != nil {
+			return nil, fmt.Errorf("proxy: decoding message %d of %s: %v", i, s.FullMethod, err)
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+// CaptureReader reads the sessions written by a Capture.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader creates a CaptureReader reading sessions from r.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// maxCaptureRecordSize bounds the size of the records read, to fail early on corrupted files.
+const maxCaptureRecordSize = 1 << 30
+
+// Next returns the next session, or io.EOF once all sessions have been read.
+func (r *CaptureReader) Next() (*CapturedSession, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("proxy: reading capture: %w", noEOF(err))
+	}
+	if n > maxCaptureRecordSize {
+		return nil, fmt.Errorf("proxy: reading capture: record of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, fmt.Errorf("proxy: reading capture: %w", noEOF(err))
+	}
+	s := &CapturedSession{}
+	if err := s.unmarshal(b); err != nil {
+		return nil, fmt.Errorf("proxy: reading capture: %v", err)
+	}
+	return s, nil
+}
+
+// noEOF turns an io.EOF in the middle of a record into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadCaptureFile reads all the sessions in the file at path, written with WithCaptureFile.
+func ReadCaptureFile(path string) ([]*CapturedSession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var sessions []*CapturedSession
+	r := NewCaptureReader(f)
+	for {
+		s, err := r.Next()
+		if err == io.EOF {
+			return sessions, nil
+		} else if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+}
+
+// Field numbers of the records of captured sessions.
+const (
+	sessionMethod    protowire.Number = 1
+	sessionPeer      protowire.Number = 2
+	sessionBackend   protowire.Number = 3
+	sessionGroup     protowire.Number = 4
+	sessionStart     protowire.Number = 5
+	sessionEnd       protowire.Number = 6
+	sessionCode      protowire.Number = 7
+	sessionMessage   protowire.Number = 8
+	sessionMetadata  protowire.Number = 9
+	sessionHeader    protowire.Number = 10
+	sessionTrailer   protowire.Number = 11
+	sessionFrame     protowire.Number = 12
+	sessionTruncated protowire.Number = 13
+
+	entryKey   protowire.Number = 1
+	entryValue protowire.Number = 2
+
+	frameDirection protowire.Number = 1
+	frameTime      protowire.Number = 2
+	framePayload   protowire.Number = 3
+	frameSize      protowire.Number = 4
+	frameTruncated protowire.Number = 5
+	frameRedacted  protowire.Number = 6
+)
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendVarint(b, num, protowire.EncodeBool(v))
+}
+
+func appendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	return appendVarint(b, num, uint64(t.UnixNano()))
+}
+
+// appendMetadata encodes md as entries with a single value each, in the order of their keys.
+func appendMetadata(b []byte, num protowire.Number, md metadata.MD) []byte {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range md[k] {
+			var entry []byte
+			entry = appendString(entry, entryKey, k)
+			entry = appendString(entry, entryValue, v)
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+	}
+	return b
+}
+
+func (s *CapturedSession) marshal() []byte {
+	var b []byte
+	b = appendString(b, sessionMethod, s.FullMethod)
+	b = appendString(b, sessionPeer, s.Peer)
+	b = appendString(b, sessionBackend, s.Backend)
+	b = appendString(b, sessionGroup, s.Group)
+	b = appendTime(b, sessionStart, s.Start)
+	b = appendTime(b, sessionEnd, s.End)
+	b = appendVarint(b, sessionCode, uint64(s.Code))
+	b = appendString(b, sessionMessage, s.Message)
+	b = appendMetadata(b, sessionMetadata, s.Metadata)
+	b = appendMetadata(b, sessionHeader, s.Header)
+	b = appendMetadata(b, sessionTrailer, s.Trailer)
+	for _, f := range s.Frames {
+		var frame []byte
+		frame = appendVarint(frame, frameDirection, uint64(f.Direction))
+		frame = appendTime(frame, frameTime, f.Time)
+		if !f.Redacted {
+			frame = protowire.AppendTag(frame, framePayload, protowire.BytesType)
+			frame = protowire.AppendBytes(frame, f.Payload)
+		}
+		frame = appendVarint(frame, frameSize, uint64(f.Size))
+		frame = appendBool(frame, frameTruncated, f.Truncated)
+		frame = appendBool(frame, frameRedacted, f.Redacted)
+		b = protowire.AppendTag(b, sessionFrame, protowire.BytesType)
+		b = protowire.AppendBytes(b, frame)
+	}
+	return appendBool(b, sessionTruncated, s.Truncated)
+}
+
+// consumeFields calls field with the value of every varint and length-delimited field in b, skipping the others.
+func consumeFields(b []byte, field func(num protowire.Number, v uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var bytes []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := field(num, v, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalTime(v uint64) time.Time {
+	return time.Unix(0, int64(v))
+}
+
+func unmarshalMetadata(md *metadata.MD, b []byte) error {
+	var key, value string
+	err := consumeFields(b, func(num protowire.Number, _ uint64, bytes []byte) error {
+		switch num {
+		case entryKey:
+			key = string(bytes)
+		case entryValue:
+			value = string(bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *md == nil {
+		*md = metadata.MD{}
+	}
+	md.Append(key, value)
+	return nil
+}
+
+func (f *CapturedFrame) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, bytes []byte) error {
+		switch num {
+		case frameDirection:
+			f.Direction = FrameDirection(v)
+		case frameTime:
+			f.Time = unmarshalTime(v)
+		case framePayload:
+			f.Payload = append([]byte{}, bytes...)
+		case frameSize:
+			f.Size = int(v)
+		case frameTruncated:
+			f.Truncated = protowire.DecodeBool(v)
+		case frameRedacted:
+			f.Redacted = protowire.DecodeBool(v)
+		}
+		return nil
+	})
+}
+
+func (s *CapturedSession) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v uint64, bytes []byte) error {
+		switch num {
+		case sessionMethod:
+			s.FullMethod = string(bytes)
+		case sessionPeer:
+			s.Peer = string(bytes)
+		case sessionBackend:
+			s.Backend = string(bytes)
+		case sessionGroup:
+			s.Group = string(bytes)
+		case sessionStart:
+			s.Start = unmarshalTime(v)
+		case sessionEnd:
+			s.End = unmarshalTime(v)
+		case sessionCode:
+			s.Code = codes.Code(v)
+		case sessionMessage:
+			s.Message = string(bytes)
+		case sessionMetadata:
+			return unmarshalMetadata(&s.Metadata, bytes)
+		case sessionHeader:
+			return unmarshalMetadata(&s.Header, bytes)
+		case sessionTrailer:
+			return unmarshalMetadata(&s.Trailer, bytes)
+		case sessionFrame:
+			f := CapturedFrame{}
+			if err := f.unmarshal(bytes); err != nil {
+				return err
+			}
+			s.Frames = append(s.Frames, f)
+		case sessionTruncated:
+			s.Truncated = protowire.DecodeBool(v)
+		}
+		return nil
+	})
+}
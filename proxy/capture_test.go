@@ -0,0 +1,214 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// captureTo returns the options capturing calls with a Capture created with opts, and assigning them the request ID
+// req-1.
+func captureTo(t *testing.T, opts ...proxy.CaptureOption) []proxy.HandlerOption {
+	t.Helper()
+	capture, err := proxy.NewCapture(opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { capture.Close() })
+	return []proxy.HandlerOption{proxy.WithCapture(capture), proxy.WithRequestIDs(proxy.RequestIDs{Generate: func() string { return "req-1" }})}
+}
+
+func readSessions(t *testing.T, r io.Reader) []*proxy.CapturedSession {
+	t.Helper()
+	var sessions []*proxy.CapturedSession
+	reader := proxy.NewCaptureReader(r)
+	for {
+		s, err := reader.Next()
+		if err == io.EOF {
+			return sessions
+		}
+		require.NoError(t, err)
+		sessions = append(sessions, s)
+	}
+}
+
+func TestCapture_FlaggedCalls(t *testing.T) {
+	out := &syncBuffer{}
+	client := proxyTestClient(t, nil, captureTo(t, proxy.WithCaptureWriter(out), proxy.WithCaptureHeader("X-Debug-Capture"),
+		proxy.WithCaptureRedactedMetadata("x-secret"))...)
+
+	_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-debug-capture", "1", "authorization", "Bearer token", "x-secret", "s3cr3t")
+	_, err = client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+
+	sessions := readSessions(t, bytes.NewReader(out.bytes()))
+	require.Len(t, sessions, 1)
+	s := sessions[0]
+	assert.Equal(t, "/mwitkow.testproto.TestService/Ping", s.FullMethod)
+	assert.Equal(t, codes.OK, s.Code)
+	assert.NotEmpty(t, s.Peer)
+	assert.False(t, s.End.Before(s.Start))
+	assert.Equal(t, []string{"1"}, s.Metadata.Get("x-debug-capture"))
+	assert.Equal(t, []string{"REDACTED"}, s.Metadata.Get("authorization"))
+	assert.Equal(t, []string{"REDACTED"}, s.Metadata.Get("x-secret"))
+	// The backend echoes the metadata it received in its headers and trailers.
+	assert.Equal(t, []string{"req-1"}, s.Header.Get(proxy.RequestIDKey))
+	assert.Empty(t, s.Metadata.Get(proxy.RequestIDKey), "generated request IDs are not metadata of the client")
+	assert.Equal(t, []string{testservice.PingHeaderCts}, s.Header.Get(testservice.PingHeader))
+	assert.Equal(t, []string{"REDACTED"}, s.Header.Get("authorization"))
+	assert.Equal(t, []string{testservice.PingTrailerCts}, s.Trailer.Get(testservice.PingTrailer))
+	assert.Equal(t, []string{"REDACTED"}, s.Trailer.Get("x-secret"))
+
+	require.Len(t, s.Frames, 2)
+	assert.Equal(t, proxy.ClientToBackend, s.Frames[0].Direction)
+	assert.Equal(t, proxy.BackendToClient, s.Frames[1].Direction)
+	assert.False(t, s.Frames[1].Time.Before(s.Frames[0].Time))
+	for _, f := range s.Frames {
+		assert.Equal(t, 7, f.Size)
+		assert.Len(t, f.Payload, 7)
+		assert.False(t, f.Truncated)
+	}
+	assert.False(t, s.Truncated)
+}
+
+func TestCapture_LimitsAndRedaction(t *testing.T) {
+	resolver, err := proxy.NewDescriptorSetResolver(testDescriptorSet())
+	require.NoError(t, err)
+	out := &syncBuffer{}
+	// Requests are redacted down to nothing and responses cut at 4 bytes, while the session fits 4 whole messages of
+	// 7 and 9 bytes.
+	client := proxyTestClient(t, nil, captureTo(t, proxy.WithCaptureWriter(out), proxy.WithCaptureLimits(4, 4*(32+9)),
+		proxy.WithCaptureRedactors(proxy.RedactMessageFields(resolver, "mwitkow.testproto.PingRequest.value")))...)
+
+	stream, err := client.PingStream(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&testservice.PingRequest{Value: "hello"}))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	sessions := readSessions(t, bytes.NewReader(out.bytes()))
+	require.Len(t, sessions, 1)
+	s := sessions[0]
+	assert.True(t, s.Truncated)
+	require.Len(t, s.Frames, 4)
+
+	msgs, err := s.DecodeFrames(context.Background(), resolver)
+	require.NoError(t, err)
+	require.Len(t, msgs, 4)
+	for i, f := range s.Frames {
+		if f.Direction == proxy.ClientToBackend {
+			assert.Equal(t, 7, f.Size)
+			assert.Empty(t, f.Payload)
+			assert.False(t, f.Truncated)
+			assert.False(t, f.Redacted)
+			require.NotNil(t, msgs[i])
+			assert.Equal(t, protoreflect.FullName("mwitkow.testproto.PingRequest"), msgs[i].Descriptor().FullName())
+			assert.Equal(t, "", msgs[i].Get(msgs[i].Descriptor().Fields().ByName("value")).String())
+		} else {
+			// Responses carry the value and the counter, and are cut at the frame limit.
+			assert.Len(t, f.Payload, 4)
+			assert.True(t, f.Truncated)
+			assert.Nil(t, msgs[i])
+		}
+	}
+}
+
+func TestCapture_EmptyAndRedactedMessages(t *testing.T) {
+	resolver, err := proxy.NewDescriptorSetResolver(testDescriptorSet())
+	require.NoError(t, err)
+	out := &syncBuffer{}
+	leaveOutResponses := func(ctx context.Context, info *proxy.FrameInfo, payload []byte) []byte {
+		if info.Direction == proxy.BackendToClient {
+			return nil
+		}
+		return payload
+	}
+	client := proxyTestClient(t, nil, captureTo(t, proxy.WithCaptureWriter(out), proxy.WithCaptureRedactors(leaveOutResponses))...)
+
+	_, err = client.PingEmpty(context.Background(), &emptypb.Empty{})
+	require.NoError(t, err)
+
+	sessions := readSessions(t, bytes.NewReader(out.bytes()))
+	require.Len(t, sessions, 1)
+	s := sessions[0]
+	require.Len(t, s.Frames, 2)
+	assert.False(t, s.Frames[0].Redacted, "empty messages must not be taken for redacted ones")
+	assert.Empty(t, s.Frames[0].Payload)
+	assert.True(t, s.Frames[1].Redacted)
+	assert.Nil(t, s.Frames[1].Payload)
+
+	msgs, err := s.DecodeFrames(context.Background(), resolver)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.NotNil(t, msgs[0])
+	assert.Equal(t, protoreflect.FullName("google.protobuf.Empty"), msgs[0].Descriptor().FullName())
+	assert.Nil(t, msgs[1])
+}
+
+func TestCapture_FileAndErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.bin")
+	client := proxyTestClient(t, nil, captureTo(t, proxy.WithCaptureFile(path, 0, 0), proxy.WithCaptureSampling("/mwitkow.testproto.TestService/PingError", 100))...)
+
+	_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	_, err = client.PingError(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.Error(t, err)
+
+	sessions, err := proxy.ReadCaptureFile(path)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "/mwitkow.testproto.TestService/PingError", sessions[0].FullMethod)
+	assert.Equal(t, codes.Unknown, sessions[0].Code)
+	assert.Equal(t, "Something is wrong and this is a message that describes it", sessions[0].Message)
+	require.Len(t, sessions[0].Frames, 1)
+	assert.Equal(t, proxy.ClientToBackend, sessions[0].Frames[0].Direction)
+}
+
+// failingWriter fails all writes.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestCapture_WriteErrors(t *testing.T) {
+	errs := make(chan error, 1)
+	client := proxyTestClient(t, nil, captureTo(t, proxy.WithCaptureWriter(failingWriter{}),
+		proxy.WithCaptureErrorCallback(func(err error) { errs <- err }))...)
+
+	_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err, "the call must not fail with the capture")
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+		assert.Contains(t, err.Error(), "/mwitkow.testproto.TestService/Ping")
+	case <-time.After(time.Second):
+		t.Fatal("the write error was not reported")
+	}
+}
+
+func TestCaptureReader_Corrupted(t *testing.T) {
+	_, err := proxy.NewCaptureReader(bytes.NewReader([]byte{10, 1, 2})).Next()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = proxy.NewCapture()
+	assert.Error(t, err)
+}
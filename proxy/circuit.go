@@ -0,0 +1,309 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all calls through, counting their failures.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all calls until the open timeout has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets probe calls through at a limited rate, and closes or opens again depending on their outcome.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitChange describes a state change of a circuit breaker.
+type CircuitChange struct {
+	Backend string
+	// Method is the full method name the breaker applies to, empty unless breakers are kept per method.
+	Method   string
+	From, To CircuitState
+}
+
+// CircuitBreakers keeps a circuit breaker per backend, and optionally per method, to stop the proxy from opening
+// streams to backends that are in trouble. Calls rejected by a breaker fail with Unavailable.
+//
+// Breakers apply to calls handled with WithCircuitBreakers and attributed to a backend by the director, see
+// StreamInfo.SetBackend.
+type CircuitBreakers struct {
+	failureThreshold int
+	successThreshold int
+	openTimeout      time.Duration
+	probeInterval    time.Duration
+	maxConcurrent    int
+	maxPending       int
+	perMethod        bool
+	failureCodes     map[codes.Code]bool
+	onChange         func(CircuitChange)
+	now              func() time.Time
+
+	mu       sync.Mutex
+	circuits map[circuitKey]*circuit
+}
+
+type circuitKey struct {
+	backend string
+	method  string
+}
+
+type circuit struct {
+	state     CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	nextProbe time.Time
+	active    int
+	pending   int
+	// freed is closed and replaced whenever a call ends, to wake up pending calls.
+	freed chan struct{}
+}
+
+// CircuitOption configures CircuitBreakers.
+type CircuitOption func(*CircuitBreakers)
+
+// WithCircuitFailureThreshold sets the number of failed calls in a row that open a closed breaker, 5 by default.
+func WithCircuitFailureThreshold(n int) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.failureThreshold = n
+	}
+}
+
+// WithCircuitSuccessThreshold sets the number of successful probes in a row that close a half-open breaker, 1 by
+// default. A failed probe opens it again.
+func WithCircuitSuccessThreshold(n int) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.successThreshold = n
+	}
+}
+
+// WithCircuitOpenTimeout sets how long a breaker stays open before it lets probes through, 30 seconds by default.
+func WithCircuitOpenTimeout(d time.Duration) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.openTimeout = d
+	}
+}
+
+// WithCircuitProbeInterval sets the rate of probes let through by a half-open breaker, one per second by default.
+func WithCircuitProbeInterval(d time.Duration) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.probeInterval = d
+	}
+}
+
+// WithCircuitMaxConcurrent limits the number of calls in flight through a breaker to maxConcurrent. Further calls
+// wait for one of them to end, but at most maxPending of them; the others are rejected. There is no limit by default.
+func WithCircuitMaxConcurrent(maxConcurrent, maxPending int) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.maxConcurrent = maxConcurrent
+		cb.maxPending = maxPending
+	}
+}
+
+// WithCircuitPerMethod keeps a breaker per backend and method, instead of one per backend.
+func WithCircuitPerMethod() CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.perMethod = true
+	}
+}
+
+// WithCircuitFailureCodes sets the status codes counted as failures, by default Unavailable and Internal.
+func WithCircuitFailureCodes(failureCodes ...codes.Code) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.failureCodes = make(map[codes.Code]bool)
+		for _, c := range failureCodes {
+			cb.failureCodes[c] = true
+		}
+	}
+}
+
+// WithCircuitStateCallback sets a function called on every state change of a breaker. It may be called concurrently
+// for different breakers.
+func WithCircuitStateCallback(f func(CircuitChange)) CircuitOption {
+	return func(cb *CircuitBreakers) {
+		cb.onChange = f
+	}
+}
+
+// NewCircuitBreakers creates CircuitBreakers, all closed.
+func NewCircuitBreakers(opts ...CircuitOption) *CircuitBreakers {
+	cb := &CircuitBreakers{
+		failureThreshold: 5,
+		successThreshold: 1,
+		openTimeout:      30 * time.Second,
+		probeInterval:    time.Second,
+		failureCodes:     map[codes.Code]bool{codes.Unavailable: true, codes.Internal: true},
+		now:              time.Now,
+		circuits:         make(map[circuitKey]*circuit),
+	}
+	for _, opt := range opts {
+		opt(cb)
+	}
+	return cb
+}
+
+// WithCircuitBreakers makes the handler pass every call attributed to a backend through cb before opening the stream
+// to the backend.
+func WithCircuitBreakers(cb *CircuitBreakers) HandlerOption {
+	return func(o *handlerOptions) {
+		o.breakers = cb
+	}
+}
+
+// State returns the state of the breaker of a backend and method. The method is ignored unless breakers are kept per
+// method.
+func (cb *CircuitBreakers) State(backend, fullMethodName string) CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c, ok := cb.circuits[cb.key(backend, fullMethodName)]; ok {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+func (cb *CircuitBreakers) key(backend, fullMethodName string) circuitKey {
+	if !cb.perMethod {
+		fullMethodName = ""
+	}
+	return circuitKey{backend: backend, method: fullMethodName}
+}
+
+// admit waits until the breaker of a backend and method lets a call through, and returns the function to call with
+// the outcome of the call once it is done.
+func (cb *CircuitBreakers) admit(ctx context.Context, backend, fullMethodName string) (func(err error), error) {
+	key := cb.key(backend, fullMethodName)
+	cb.mu.Lock()
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{freed: make(chan struct{})}
+		cb.circuits[key] = c
+	}
+	var changes []CircuitChange
+	var err error
+	probe := false
+	for {
+		// The breaker is checked again after every wait, as its state may have changed meanwhile.
+		now := cb.now()
+		if c.state == CircuitOpen && now.Sub(c.openedAt) >= cb.openTimeout {
+			changes = append(changes, cb.transitionLocked(key, c, CircuitHalfOpen, now))
+		}
+		if err = cb.checkLocked(key, c, now); err != nil {
+			break
+		}
+		if cb.maxConcurrent <= 0 || c.active < cb.maxConcurrent {
+			if probe = c.state == CircuitHalfOpen; probe {
+				c.nextProbe = now.Add(cb.probeInterval)
+			}
+			break
+		}
+		if c.pending >= cb.maxPending {
+			err = status.Errorf(codes.Unavailable, "proxy: too many pending streams to backend %q", backend)
+			break
+		}
+		c.pending++
+		freed := c.freed
+		cb.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			err = status.FromContextError(ctx.Err()).Err()
+		case <-freed:
+		}
+		cb.mu.Lock()
+		c.pending--
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		c.active++
+	}
+	cb.mu.Unlock()
+	cb.notify(changes)
+	if err != nil {
+		return nil, err
+	}
+	return func(err error) { cb.release(key, c, probe, err) }, nil
+}
+
+// checkLocked returns the error rejecting a call if the breaker does not let it through.
+func (cb *CircuitBreakers) checkLocked(key circuitKey, c *circuit, now time.Time) error {
+	switch {
+	case c.state == CircuitOpen:
+		return status.Errorf(codes.Unavailable, "proxy: circuit breaker for backend %q is open", key.backend)
+	case c.state == CircuitHalfOpen && now.Before(c.nextProbe):
+		return status.Errorf(codes.Unavailable, "proxy: circuit breaker for backend %q is half-open, waiting for probes", key.backend)
+	}
+	return nil
+}
+
+func (cb *CircuitBreakers) release(key circuitKey, c *circuit, probe bool, err error) {
+	cb.mu.Lock()
+	c.active--
+	close(c.freed)
+	c.freed = make(chan struct{})
+	now := cb.now()
+	failed := err != nil && cb.failureCodes[status.Code(err)]
+	var changes []CircuitChange
+	switch {
+	case c.state == CircuitClosed && failed:
+		if c.failures++; c.failures >= cb.failureThreshold {
+			changes = append(changes, cb.transitionLocked(key, c, CircuitOpen, now))
+		}
+	case c.state == CircuitClosed:
+		c.failures = 0
+	case c.state == CircuitHalfOpen && probe && failed:
+		changes = append(changes, cb.transitionLocked(key, c, CircuitOpen, now))
+	case c.state == CircuitHalfOpen && probe:
+		if c.successes++; c.successes >= cb.successThreshold {
+			changes = append(changes, cb.transitionLocked(key, c, CircuitClosed, now))
+		}
+	}
+	cb.mu.Unlock()
+	cb.notify(changes)
+}
+
+func (cb *CircuitBreakers) transitionLocked(key circuitKey, c *circuit, to CircuitState, now time.Time) CircuitChange {
+	change := CircuitChange{Backend: key.backend, Method: key.method, From: c.state, To: to}
+	c.state = to
+	c.failures, c.successes = 0, 0
+	switch to {
+	case CircuitOpen:
+		c.openedAt = now
+	case CircuitHalfOpen:
+		c.nextProbe = now
+	}
+	return change
+}
+
+func (cb *CircuitBreakers) notify(changes []CircuitChange) {
+	if cb.onChange == nil {
+		return
+	}
+	for _, change := range changes {
+		cb.onChange(change)
+	}
+}
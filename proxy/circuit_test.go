@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestCircuitBreakers(opts ...CircuitOption) (*CircuitBreakers, *fakeClock, *[]CircuitChange) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var mu sync.Mutex
+	changes := &[]CircuitChange{}
+	opts = append(opts, WithCircuitStateCallback(func(c CircuitChange) {
+		mu.Lock()
+		defer mu.Unlock()
+		*changes = append(*changes, c)
+	}))
+	cb := NewCircuitBreakers(opts...)
+	cb.now = clock.now
+	return cb, clock, changes
+}
+
+func runThroughBreaker(t *testing.T, cb *CircuitBreakers, backend string, err error) error {
+	t.Helper()
+	release, admitErr := cb.admit(context.Background(), backend, "/some.Service/Method")
+	if admitErr != nil {
+		return admitErr
+	}
+	release(err)
+	return nil
+}
+
+func TestCircuitBreakers_States(t *testing.T) {
+	cb, clock, changes := newTestCircuitBreakers(
+		WithCircuitFailureThreshold(3),
+		WithCircuitSuccessThreshold(2),
+		WithCircuitOpenTimeout(10*time.Second),
+		WithCircuitProbeInterval(time.Second),
+	)
+	failure := status.Error(codes.Unavailable, "down")
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, runThroughBreaker(t, cb, "a", failure))
+	}
+	require.NoError(t, runThroughBreaker(t, cb, "a", status.Error(codes.NotFound, "not a failure of the backend")))
+	require.NoError(t, runThroughBreaker(t, cb, "a", nil))
+	assert.Equal(t, CircuitClosed, cb.State("a", ""), "successes reset the failure count")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, runThroughBreaker(t, cb, "a", failure))
+	}
+	assert.Equal(t, CircuitOpen, cb.State("a", ""))
+	err := runThroughBreaker(t, cb, "a", nil)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), `circuit breaker for backend "a" is open`)
+	assert.NoError(t, runThroughBreaker(t, cb, "b", nil), "breakers are per backend")
+
+	// A failed probe opens the breaker again.
+	clock.advance(10 * time.Second)
+	require.NoError(t, runThroughBreaker(t, cb, "a", failure))
+	assert.Equal(t, CircuitOpen, cb.State("a", ""))
+
+	// Probes are rate limited, and enough successful ones close the breaker.
+	clock.advance(10 * time.Second)
+	require.NoError(t, runThroughBreaker(t, cb, "a", nil))
+	assert.Equal(t, CircuitHalfOpen, cb.State("a", ""))
+	assert.Equal(t, codes.Unavailable, status.Code(runThroughBreaker(t, cb, "a", nil)))
+	clock.advance(time.Second)
+	require.NoError(t, runThroughBreaker(t, cb, "a", nil))
+	assert.Equal(t, CircuitClosed, cb.State("a", ""))
+
+	var states []string
+	for _, c := range *changes {
+		assert.Equal(t, "a", c.Backend)
+		states = append(states, c.From.String()+">"+c.To.String())
+	}
+	assert.Equal(t, []string{"closed>open", "open>half_open", "half_open>open", "open>half_open", "half_open>closed"}, states)
+}
+
+func TestCircuitBreakers_MaxConcurrent(t *testing.T) {
+	cb, _, _ := newTestCircuitBreakers(WithCircuitMaxConcurrent(1, 1))
+	release, err := cb.admit(context.Background(), "a", "/some.Service/Method")
+	require.NoError(t, err)
+
+	admitted := make(chan func(error))
+	go func() {
+		r, err := cb.admit(context.Background(), "a", "/some.Service/Method")
+		assert.NoError(t, err)
+		admitted <- r
+	}()
+	require.Eventually(t, func() bool {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		return cb.circuits[circuitKey{backend: "a"}].pending == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = cb.admit(context.Background(), "a", "/some.Service/Method")
+	assert.Equal(t, codes.Unavailable, status.Code(err), "only one call may be pending")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cb.admit(ctx, "b", "/some.Service/Method")
+	assert.NoError(t, err, "other backends are not limited")
+
+	release(nil)
+	(<-admitted)(nil)
+}
+
+func TestCircuitBreakers_PendingCallsSeeCurrentState(t *testing.T) {
+	cb, _, _ := newTestCircuitBreakers(WithCircuitFailureThreshold(1), WithCircuitOpenTimeout(10*time.Second),
+		WithCircuitMaxConcurrent(1, 1))
+	// The breaker opens when the first call is released, and its open timeout is over by the time the pending call
+	// is let through.
+	start, calls := time.Unix(1000, 0), 0
+	cb.now = func() time.Time {
+		if calls++; calls > 3 {
+			return start.Add(time.Minute)
+		}
+		return start
+	}
+	release, err := cb.admit(context.Background(), "a", "/some.Service/Method")
+	require.NoError(t, err)
+
+	admitted := make(chan func(error))
+	go func() {
+		r, err := cb.admit(context.Background(), "a", "/some.Service/Method")
+		assert.NoError(t, err, "the pending call must be let through as a probe")
+		admitted <- r
+	}()
+	require.Eventually(t, func() bool {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		return cb.circuits[circuitKey{backend: "a"}].pending == 1
+	}, time.Second, time.Millisecond)
+
+	release(status.Error(codes.Unavailable, "down"))
+	probe := <-admitted
+	require.NotNil(t, probe)
+	assert.Equal(t, CircuitHalfOpen, cb.State("a", ""))
+	probe(nil)
+	assert.Equal(t, CircuitClosed, cb.State("a", ""), "the pending call must count as a probe")
+}
+
+func TestCircuitBreakers_PerMethod(t *testing.T) {
+	cb, _, changes := newTestCircuitBreakers(WithCircuitFailureThreshold(1), WithCircuitPerMethod())
+	release, err := cb.admit(context.Background(), "a", "/some.Service/Broken")
+	require.NoError(t, err)
+	release(status.Error(codes.Internal, "oops"))
+
+	assert.Equal(t, CircuitOpen, cb.State("a", "/some.Service/Broken"))
+	assert.Equal(t, CircuitClosed, cb.State("a", "/some.Service/Working"))
+	_, err = cb.admit(context.Background(), "a", "/some.Service/Working")
+	assert.NoError(t, err)
+	require.Len(t, *changes, 1)
+	assert.Equal(t, "/some.Service/Broken", (*changes)[0].Method)
+}
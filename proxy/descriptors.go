@@ -0,0 +1,290 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// DescriptorResolver finds the protobuf descriptors of proxied methods, allowing the otherwise opaque messages to be
+// decoded.
+//
+// Errors returned should be created with the `status` package, as they may be returned to the client.
+type DescriptorResolver interface {
+	// ResolveMethod returns the descriptor of a method, given the full RPC method string, i.e., /package.service/method.
+	ResolveMethod(ctx context.Context, fullMethodName string) (protoreflect.MethodDescriptor, error)
+}
+
+// NewReflectionResolver returns a DescriptorResolver that fetches descriptors from the gRPC server reflection service
+// of the backend behind cc. Descriptors are fetched once per service and then cached for the lifetime of the resolver.
+func NewReflectionResolver(cc grpc.ClientConnInterface) DescriptorResolver {
+	return &reflectionResolver{
+		client: rpb.NewServerReflectionClient(cc),
+		cache:  newDescriptorCache(),
+	}
+}
+
+// NewDescriptorSetResolver returns a DescriptorResolver serving the methods of all services in a FileDescriptorSet.
+// The set needs to be self-contained, as produced by `protoc --include_imports --descriptor_set_out`.
+func NewDescriptorSetResolver(set *descriptorpb.FileDescriptorSet) (DescriptorResolver, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: building descriptor set: %v", err)
+	}
+	c := newDescriptorCache()
+	c.files = files
+	return c, nil
+}
+
+// NewDescriptorSetFileResolver is like NewDescriptorSetResolver, but reads the serialized FileDescriptorSet from a file.
+func NewDescriptorSetFileResolver(path string) (DescriptorResolver, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: reading descriptor set: %v", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("proxy: parsing descriptor set %q: %v", path, err)
+	}
+	return NewDescriptorSetResolver(set)
+}
+
+// descriptorCache keeps the file descriptors known to a resolver, with the methods resolved so far indexed by their
+// full method name.
+type descriptorCache struct {
+	mu      sync.RWMutex
+	files   *protoregistry.Files
+	methods map[string]protoreflect.MethodDescriptor
+}
+
+func newDescriptorCache() *descriptorCache {
+	return &descriptorCache{
+		files:   &protoregistry.Files{},
+		methods: make(map[string]protoreflect.MethodDescriptor),
+	}
+}
+
+func (c *descriptorCache) ResolveMethod(_ context.Context, fullMethodName string) (protoreflect.MethodDescriptor, error) {
+	if md, ok := c.lookup(fullMethodName); ok {
+		return md, nil
+	}
+	return nil, status.Errorf(codes.Unimplemented, "proxy: no descriptor for method %s", fullMethodName)
+}
+
+func (c *descriptorCache) lookup(fullMethodName string) (protoreflect.MethodDescriptor, bool) {
+	c.mu.RLock()
+	md, ok := c.methods[fullMethodName]
+	c.mu.RUnlock()
+	if ok {
+		return md, true
+	}
+
+	serviceName, methodName, ok := splitMethodName(fullMethodName)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, false
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, false
+	}
+	md = sd.Methods().ByName(protoreflect.Name(methodName))
+	if md == nil {
+		return nil, false
+	}
+	c.methods[fullMethodName] = md
+	return md, true
+}
+
+// add registers the file called name from fds in the cache, together with all of its dependencies. Files that are
+// already known are skipped.
+func (c *descriptorCache) add(fds map[string]*descriptorpb.FileDescriptorProto, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addLocked(fds, name)
+}
+
+func (c *descriptorCache) addLocked(fds map[string]*descriptorpb.FileDescriptorProto, name string) error {
+	if _, err := c.files.FindFileByPath(name); err == nil {
+		return nil
+	}
+	fd, ok := fds[name]
+	if !ok {
+		return fmt.Errorf("missing file descriptor %q", name)
+	}
+	for _, dep := range fd.GetDependency() {
+		if err := c.addLocked(fds, dep); err != nil {
+			return err
+		}
+	}
+	file, err := protodesc.NewFile(fd, c.files)
+	if err != nil {
+		return fmt.Errorf("building file descriptor %q: %v", name, err)
+	}
+	return c.files.RegisterFile(file)
+}
+
+// has returns whether the file called name is already known.
+func (c *descriptorCache) has(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, err := c.files.FindFileByPath(name)
+	return err == nil
+}
+
+type reflectionResolver struct {
+	client rpb.ServerReflectionClient
+	cache  *descriptorCache
+}
+
+func (r *reflectionResolver) ResolveMethod(ctx context.Context, fullMethodName string) (protoreflect.MethodDescriptor, error) {
+	if md, ok := r.cache.lookup(fullMethodName); ok {
+		return md, nil
+	}
+	serviceName, _, ok := splitMethodName(fullMethodName)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "proxy: malformed method name %s", fullMethodName)
+	}
+	if err := r.fetchService(ctx, serviceName); err != nil {
+		return nil, err
+	}
+	if md, ok := r.cache.lookup(fullMethodName); ok {
+		return md, nil
+	}
+	return nil, status.Errorf(codes.Unimplemented, "proxy: no descriptor for method %s", fullMethodName)
+}
+
+// fetchService asks the reflection service for the file defining serviceName and all files it depends on.
+func (r *reflectionResolver) fetchService(ctx context.Context, serviceName string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := r.client.ServerReflectionInfo(ctx)
+	if err != nil {
+		return err
+	}
+	fds := make(map[string]*descriptorpb.FileDescriptorProto)
+	root, err := r.fetch(stream, fds, &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: serviceName},
+	})
+	if err != nil {
+		return err
+	}
+	// The server may not send all transitive dependencies at once, so we ask for the missing ones one by one.
+	pending := []string{root}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		for _, dep := range fds[name].GetDependency() {
+			if _, ok := fds[dep]; ok || r.cache.has(dep) {
+				continue
+			}
+			if _, err := r.fetch(stream, fds, &rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+			}); err != nil {
+				return err
+			}
+			if _, ok := fds[dep]; !ok {
+				return status.Errorf(codes.Unimplemented, "proxy: reflection did not return file %q", dep)
+			}
+			pending = append(pending, dep)
+		}
+	}
+	stream.CloseSend()
+	if err := r.cache.add(fds, root); err != nil {
+		return status.Errorf(codes.Internal, "proxy: resolving descriptors of %s: %v", serviceName, err)
+	}
+	return nil
+}
+
+// fetch sends a single reflection request and adds the returned files to fds. It returns the name of the first file
+// in the response, which is the one asked for.
+func (r *reflectionResolver) fetch(stream rpb.ServerReflection_ServerReflectionInfoClient, fds map[string]*descriptorpb.FileDescriptorProto, req *rpb.ServerReflectionRequest) (string, error) {
+	if err := stream.Send(req); err != nil {
+		return "", err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return "", err
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return "", status.Errorf(codes.Unimplemented, "proxy: reflection: %s", errResp.GetErrorMessage())
+	}
+	var first string
+	for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(b, fd); err != nil {
+			return "", status.Errorf(codes.Internal, "proxy: reflection returned a malformed descriptor: %v", err)
+		}
+		if first == "" {
+			first = fd.GetName()
+		}
+		fds[fd.GetName()] = fd
+	}
+	if first == "" {
+		return "", status.Errorf(codes.Unimplemented, "proxy: reflection returned no descriptors")
+	}
+	return first, nil
+}
+
+// splitMethodName splits a full RPC method string, i.e., /package.service/method, into its service and method.
+func splitMethodName(fullMethodName string) (string, string, bool) {
+	name := strings.TrimPrefix(fullMethodName, "/")
+	i := strings.LastIndex(name, "/")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// MessageInterceptor is like a FrameInterceptor, but operates on decoded messages.
+//
+// The message is a dynamic message of the input or output type of the method, depending on the direction, and can be
+// modified in place to alter what is forwarded. Returning ErrDropFrame skips the message, while any other error aborts
+// the stream, as with FrameInterceptor.
+type MessageInterceptor func(ctx context.Context, info *FrameInfo, msg protoreflect.Message) error
+
+// WithMessageInterceptors adds MessageInterceptors invoked for every forwarded message. The resolver is used to find
+// the message types of each method; calls to methods it cannot resolve are aborted with the error it returns.
+func WithMessageInterceptors(resolver DescriptorResolver, interceptors ...MessageInterceptor) HandlerOption {
+	return WithFrameInterceptors(func(ctx context.Context, info *FrameInfo, payload []byte) ([]byte, error) {
+		md, err := resolver.ResolveMethod(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		desc := md.Input()
+		if info.Direction == BackendToClient {
+			desc = md.Output()
+		}
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, status.Errorf(codes.Internal, "proxy: decoding %s: %v", desc.FullName(), err)
+		}
+		for _, interceptor := range interceptors {
+			if err := interceptor(ctx, info, msg); err != nil {
+				return nil, err
+			}
+		}
+		return proto.Marshal(msg)
+	})
+}
@@ -0,0 +1,96 @@
+package proxy_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// reflectingBackendDialer is like backendDialer, but the backend also serves the gRPC server reflection service.
+func reflectingBackendDialer(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	testSrv := grpc.NewServer()
+	testservice.RegisterTestServiceServer(testSrv, testservice.DefaultTestServiceServer)
+	reflection.Register(testSrv)
+	cc, err := serverDialer(t, testSrv)
+	require.NoError(t, err)
+	return cc
+}
+
+func testDescriptorSet() *descriptorpb.FileDescriptorSet {
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(emptypb.File_google_protobuf_empty_proto),
+			protodesc.ToFileDescriptorProto(testservice.File_test_proto),
+		},
+	}
+}
+
+func TestDescriptorResolvers(t *testing.T) {
+	setResolver, err := proxy.NewDescriptorSetResolver(testDescriptorSet())
+	require.NoError(t, err)
+
+	b, err := proto.Marshal(testDescriptorSet())
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "test.protoset")
+	require.NoError(t, os.WriteFile(path, b, 0o644))
+	fileResolver, err := proxy.NewDescriptorSetFileResolver(path)
+	require.NoError(t, err)
+
+	for name, resolver := range map[string]proxy.DescriptorResolver{
+		"reflection":  proxy.NewReflectionResolver(reflectingBackendDialer(t)),
+		"set":         setResolver,
+		"setFromFile": fileResolver,
+	} {
+		t.Run(name, func(t *testing.T) {
+			md, err := resolver.ResolveMethod(context.Background(), "/mwitkow.testproto.TestService/PingEmpty")
+			require.NoError(t, err)
+			assert.Equal(t, protoreflect.FullName("google.protobuf.Empty"), md.Input().FullName())
+			assert.Equal(t, protoreflect.FullName("mwitkow.testproto.PingResponse"), md.Output().FullName())
+
+			// Served from the cache.
+			again, err := resolver.ResolveMethod(context.Background(), "/mwitkow.testproto.TestService/PingEmpty")
+			require.NoError(t, err)
+			assert.Equal(t, md, again)
+
+			_, err = resolver.ResolveMethod(context.Background(), "/mwitkow.testproto.TestService/NoSuchMethod")
+			assert.Equal(t, codes.Unimplemented, status.Code(err))
+			_, err = resolver.ResolveMethod(context.Background(), "/mwitkow.testproto.NoSuchService/Ping")
+			assert.Equal(t, codes.Unimplemented, status.Code(err))
+		})
+	}
+}
+
+func TestMessageInterceptors(t *testing.T) {
+	backendCC := reflectingBackendDialer(t)
+	rewrite := func(ctx context.Context, info *proxy.FrameInfo, msg protoreflect.Message) error {
+		field := msg.Descriptor().Fields().ByName("value")
+		msg.Set(field, protoreflect.ValueOfString(msg.Get(field).String()+" via "+info.Direction.String()))
+		return nil
+	}
+	proxySrv := grpc.NewServer(proxy.DefaultProxyOpt(backendCC,
+		proxy.WithMessageInterceptors(proxy.NewReflectionResolver(backendCC), rewrite)))
+	proxyCC, err := proxyDialer(t, proxySrv)
+	require.NoError(t, err)
+	client := testservice.NewTestServiceClient(proxyCC)
+
+	resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello via client_to_backend via backend_to_client", resp.Value)
+}
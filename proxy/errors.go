@@ -0,0 +1,56 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorMapper rewrites the error a proxied call ends with, before it is returned to the client.
+//
+// The error passed in has already been translated into a gRPC status and is nil if the call succeeded. Backend
+// errors are passed as received, including their details. Returning nil makes the call succeed.
+type ErrorMapper func(ctx context.Context, fullMethodName string, err error) error
+
+// WithErrorMapper sets an ErrorMapper applied to the outcome of every proxied call. Errors returned by the
+// StreamDirector go through the mapper too. Outlier detection and circuit breakers see errors before they are mapped.
+func WithErrorMapper(mapper ErrorMapper) HandlerOption {
+	return func(o *handlerOptions) {
+		o.errorMapper = mapper
+	}
+}
+
+// toStatusError translates an error encountered while proxying into a gRPC status error. Status errors, such as the
+// ones received from the backend, are kept intact so that their details reach the client.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var abortErr *frameAbortError
+	if errors.As(err, &abortErr) {
+		err = abortErr.err
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return status.Errorf(codes.Unavailable, "proxy: stream closed unexpectedly: %v", err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return status.Errorf(codes.Unavailable, "proxy: %v", err)
+	}
+	return status.Errorf(codes.Internal, "proxy: %v", err)
+}
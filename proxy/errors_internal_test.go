@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToStatusError(t *testing.T) {
+	backendErr := status.Error(codes.ResourceExhausted, "backend says no")
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: nil, code: codes.OK},
+		{err: backendErr, code: codes.ResourceExhausted},
+		{err: &frameAbortError{backendErr}, code: codes.ResourceExhausted},
+		{err: context.Canceled, code: codes.Canceled},
+		{err: fmt.Errorf("wrapped: %w", context.DeadlineExceeded), code: codes.DeadlineExceeded},
+		{err: io.ErrUnexpectedEOF, code: codes.Unavailable},
+		{err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, code: codes.Unavailable},
+		{err: errors.New("something else"), code: codes.Internal},
+	} {
+		assert.Equal(t, tc.code, status.Code(toStatusError(tc.err)), "error: %v", tc.err)
+	}
+	assert.Equal(t, backendErr, toStatusError(backendErr), "backend statuses must be passed as is")
+}
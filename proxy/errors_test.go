@@ -0,0 +1,112 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// detailedErrorService fails PingError with a status carrying details and trailers.
+type detailedErrorService struct {
+	testservice.TestServiceServer
+}
+
+func (detailedErrorService) PingError(ctx context.Context, _ *testservice.PingRequest) (*emptypb.Empty, error) {
+	grpc.SetTrailer(ctx, metadata.Pairs("error-trailer", "present"))
+	st, err := status.New(codes.ResourceExhausted, "quota exceeded").WithDetails(&testservice.PingResponse{Value: "details"})
+	if err != nil {
+		return nil, err
+	}
+	return nil, st.Err()
+}
+
+var detailedErrors = detailedErrorService{testservice.DefaultTestServiceServer}
+
+func TestHandler_PropagatesStatusDetailsAndTrailers(t *testing.T) {
+	client := proxyTestClient(t, detailedErrors)
+
+	trailer := metadata.MD{}
+	_, err := client.PingError(context.Background(), &testservice.PingRequest{}, grpc.Trailer(&trailer))
+	require.Error(t, err)
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Equal(t, "quota exceeded", st.Message())
+	require.Len(t, st.Details(), 1)
+	assert.True(t, proto.Equal(&testservice.PingResponse{Value: "details"}, st.Details()[0].(proto.Message)))
+	assert.Equal(t, []string{"present"}, trailer.Get("error-trailer"))
+}
+
+func TestHandler_ErrorMapper(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]codes.Code)
+	mapper := func(ctx context.Context, fullMethodName string, err error) error {
+		mu.Lock()
+		seen[fullMethodName] = status.Code(err)
+		mu.Unlock()
+		if status.Code(err) == codes.ResourceExhausted {
+			return status.Error(codes.Unavailable, "try again later")
+		}
+		return err
+	}
+	client := proxyTestClient(t, detailedErrors, proxy.WithErrorMapper(mapper))
+
+	_, err := client.PingError(context.Background(), &testservice.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, "try again later", status.Convert(err).Message())
+
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "hello"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	cancel()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := seen["/mwitkow.testproto.TestService/PingStream"]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]codes.Code{
+		"/mwitkow.testproto.TestService/PingError":  codes.ResourceExhausted,
+		"/mwitkow.testproto.TestService/Ping":       codes.OK,
+		"/mwitkow.testproto.TestService/PingStream": codes.Canceled,
+	}, seen)
+}
+
+func TestHandler_ErrorMapperHidesErrorsFromClientsOnly(t *testing.T) {
+	detector := proxy.NewOutlierDetector(proxy.WithOutlierConsecutiveFailures(2), proxy.WithOutlierMaxEjectionPercent(100),
+		proxy.WithOutlierFailureCodes(codes.ResourceExhausted))
+	mapper := func(ctx context.Context, fullMethodName string, err error) error {
+		return status.Error(codes.NotFound, "hidden")
+	}
+	breakers := proxy.NewCircuitBreakers(proxy.WithCircuitFailureThreshold(2), proxy.WithCircuitFailureCodes(codes.ResourceExhausted))
+	client := balancedTestClient(t, detailedErrors, proxy.WithOutlierDetection(detector), proxy.WithCircuitBreakers(breakers),
+		proxy.WithErrorMapper(mapper))
+
+	for i := 0; i < 2; i++ {
+		_, err := client.PingError(context.Background(), &testservice.PingRequest{})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	}
+	assert.Equal(t, []string{"backend"}, detector.EjectedBackends(), "the detector must see the errors of the backend")
+	assert.Equal(t, proxy.CircuitOpen, breakers.State("backend", ""), "the breakers must see the errors of the backend")
+}
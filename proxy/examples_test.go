@@ -6,7 +6,9 @@ package proxy_test
 import (
 	"context"
 	"log"
+	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/mwitkow/grpc-proxy/proxy"
 
@@ -43,8 +45,61 @@ func ExampleTransparentHandler() {
 		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)))
 }
 
+func ExampleWithForwardedHeaders() {
+	// Keep the forwarding metadata set by the load balancers in front of the proxy, but not by anyone else.
+	fwd := proxy.ForwardedHeaders{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	grpc.NewServer(
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, proxy.WithForwardedHeaders(fwd))))
+}
+
+// Provides a director that forwards calls to staging or production backends over shared connections.
+func ExampleBackendPool_Director() {
+	pool := proxy.NewBackendPool(
+		proxy.WithPoolDialOptions(grpc.WithInsecure()),
+		proxy.WithPoolIdleTimeout(5*time.Minute),
+	)
+	defer pool.Close()
+	director = pool.Director(func(ctx context.Context, fullMethodName string) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if val := md.Get(":authority"); len(val) > 0 && val[0] == "staging.api.example.com" {
+			return "api-service.staging.svc.local", nil
+		}
+		return "api-service.prod.svc.local", nil
+	})
+}
+
+// Provides a router that skips backends failing their health checks.
+func ExampleHealthChecker() {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(grpc.WithInsecure()))
+	defer pool.Close()
+	cfg, err := proxy.LoadRouterConfig("/etc/grpc-proxy/routes.yaml")
+	if err != nil {
+		log.Fatalf("loading routes: %v", err)
+	}
+
+	checker, err := proxy.NewHealthChecker(proxy.WithHealthInterval(10 * time.Second))
+	if err != nil {
+		log.Fatalf("creating health checker: %v", err)
+	}
+	defer checker.Close()
+	for name, backend := range cfg.Backends {
+		cc, _, err := pool.Acquire(context.Background(), backend.Target)
+		if err != nil {
+			log.Fatalf("dialing %s: %v", name, err)
+		}
+		checker.Add(name, cc)
+	}
+	router, err := proxy.NewRouter(cfg, pool, proxy.WithRouterServiceHealth(checker.ServiceHealthy))
+	if err != nil {
+		log.Fatalf("building router: %v", err)
+	}
+	director = router.Director
+}
+
 // Provides a simple example of a director that shields internal services and dials a staging or production backend.
-// This is a *very naive* implementation that creates a new connection on every request. Consider using pooling.
+// This is a *very naive* implementation that creates a new connection on every request. Consider using a BackendPool.
 func ExampleStreamDirector() {
 	director = func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
 		// Make sure we never forward internal services.
@@ -0,0 +1,150 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Metadata keys carrying the chain of clients and proxies a call has passed through.
+const (
+	XForwardedForKey   = "x-forwarded-for"
+	XForwardedHostKey  = "x-forwarded-host"
+	XForwardedProtoKey = "x-forwarded-proto"
+	// ForwardedKey is the RFC 7239 `forwarded` header.
+	ForwardedKey = "forwarded"
+)
+
+// ForwardedHeaders configures how the proxy records the inbound peer in the metadata sent to the backend, when given
+// to the handler with WithForwardedHeaders.
+//
+// For every call, the address of the inbound peer is appended to `x-forwarded-for`, the original `:authority` to
+// `x-forwarded-host`, the protocol to `x-forwarded-proto`, and all three to an RFC 7239 `forwarded` element.
+type ForwardedHeaders struct {
+	// TrustedProxies lists the networks of peers that are allowed to supply forwarding metadata, i.e. other proxies
+	// in front of this one. Values received from peers outside of these networks are stripped before the proxy
+	// appends its own entry, so that clients cannot spoof their origin. An empty list trusts nobody.
+	TrustedProxies []netip.Prefix
+}
+
+// appendTo returns outCtx with the forwarding metadata of the call in inCtx appended to its outgoing metadata.
+func (f ForwardedHeaders) appendTo(inCtx, outCtx context.Context) context.Context {
+	var addr net.Addr
+	proto := "http"
+	if p, ok := peer.FromContext(inCtx); ok {
+		addr = p.Addr
+		if p.AuthInfo != nil {
+			proto = "https"
+		}
+	}
+	var host string
+	if inMd, ok := metadata.FromIncomingContext(inCtx); ok {
+		if vals := inMd.Get(":authority"); len(vals) > 0 {
+			host = vals[0]
+		}
+	}
+
+	md, _ := metadata.FromOutgoingContext(outCtx)
+	md = md.Copy()
+	if !f.trusts(addr) {
+		for _, k := range []string{XForwardedForKey, XForwardedHostKey, XForwardedProtoKey, ForwardedKey} {
+			delete(md, k)
+		}
+	}
+
+	// Only the first proxy in a chain gets to set the original host and protocol.
+	if len(md.Get(XForwardedHostKey)) == 0 && host != "" {
+		md.Set(XForwardedHostKey, host)
+	}
+	if len(md.Get(XForwardedProtoKey)) == 0 {
+		md.Set(XForwardedProtoKey, proto)
+	}
+	md.Set(XForwardedForKey, appendList(md.Get(XForwardedForKey), forwardedForIP(addr)))
+
+	element := "for=" + forwardedNode(addr)
+	if host != "" {
+		element += ";host=" + quoteForwarded(host)
+	}
+	element += ";proto=" + proto
+	md.Set(ForwardedKey, appendList(md.Get(ForwardedKey), element))
+
+	return metadata.NewOutgoingContext(outCtx, md)
+}
+
+// trusts returns whether the peer at addr is allowed to supply forwarding metadata.
+func (f ForwardedHeaders) trusts(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+	for _, p := range f.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendList merges the, possibly repeated, values of a comma-separated list header and appends v to the end.
+func appendList(vals []string, v string) string {
+	vals = append(vals[:len(vals):len(vals)], v)
+	return strings.Join(vals, ", ")
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(addr.String()); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// forwardedForIP returns the bare IP of addr as used in `x-forwarded-for`.
+func forwardedForIP(addr net.Addr) string {
+	if ip, ok := addrIP(addr); ok {
+		return ip.String()
+	}
+	return "unknown"
+}
+
+// forwardedNode formats addr as an RFC 7239 node, quoting it where the grammar requires.
+func forwardedNode(addr net.Addr) string {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return "unknown"
+	}
+	if ip.Is6() {
+		return quoteForwarded("[" + ip.String() + "]")
+	}
+	return ip.String()
+}
+
+func quoteForwarded(v string) string {
+	for _, r := range v {
+		if !isForwardedToken(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// isForwardedToken reports whether r is a valid HTTP token character (RFC 7230, section 3.2.6).
+func isForwardedToken(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func forwardedTestContext(addr string, authInfo credentials.AuthInfo, inMd metadata.MD) context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP(addr), Port: 4242},
+		AuthInfo: authInfo,
+	})
+	ctx = metadata.NewIncomingContext(ctx, inMd)
+	return metadata.NewOutgoingContext(ctx, inMd.Copy())
+}
+
+func TestForwardedHeaders_FirstHop(t *testing.T) {
+	ctx := forwardedTestContext("10.0.0.1", nil, metadata.Pairs(":authority", "api.example.com"))
+	out := ForwardedHeaders{}.appendTo(ctx, ctx)
+
+	md, ok := metadata.FromOutgoingContext(out)
+	require.True(t, ok, "outgoing context must carry metadata")
+	assert.Equal(t, []string{"10.0.0.1"}, md.Get(XForwardedForKey))
+	assert.Equal(t, []string{"api.example.com"}, md.Get(XForwardedHostKey))
+	assert.Equal(t, []string{"http"}, md.Get(XForwardedProtoKey))
+	assert.Equal(t, []string{"for=10.0.0.1;host=api.example.com;proto=http"}, md.Get(ForwardedKey))
+}
+
+func TestForwardedHeaders_TrustedChainIsAppended(t *testing.T) {
+	inMd := metadata.Pairs(
+		":authority", "proxy.internal:443",
+		XForwardedForKey, "203.0.113.7",
+		XForwardedHostKey, "api.example.com",
+		XForwardedProtoKey, "https",
+		ForwardedKey, "for=203.0.113.7;host=api.example.com;proto=https",
+	)
+	ctx := forwardedTestContext("2001:db8::1", credentials.TLSInfo{}, inMd)
+	fwd := ForwardedHeaders{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}}
+	out := fwd.appendTo(ctx, ctx)
+
+	md, _ := metadata.FromOutgoingContext(out)
+	assert.Equal(t, []string{"203.0.113.7, 2001:db8::1"}, md.Get(XForwardedForKey))
+	assert.Equal(t, []string{"api.example.com"}, md.Get(XForwardedHostKey), "original host must be kept")
+	assert.Equal(t, []string{"https"}, md.Get(XForwardedProtoKey))
+	assert.Equal(t,
+		[]string{`for=203.0.113.7;host=api.example.com;proto=https, for="[2001:db8::1]";host="proxy.internal:443";proto=https`},
+		md.Get(ForwardedKey))
+}
+
+func TestForwardedHeaders_UntrustedValuesAreStripped(t *testing.T) {
+	inMd := metadata.Pairs(
+		":authority", "api.example.com",
+		XForwardedForKey, "1.2.3.4",
+		XForwardedHostKey, "spoofed.example.com",
+		ForwardedKey, "for=1.2.3.4",
+	)
+	ctx := forwardedTestContext("192.0.2.10", nil, inMd)
+	fwd := ForwardedHeaders{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	out := fwd.appendTo(ctx, ctx)
+
+	md, _ := metadata.FromOutgoingContext(out)
+	assert.Equal(t, []string{"192.0.2.10"}, md.Get(XForwardedForKey))
+	assert.Equal(t, []string{"api.example.com"}, md.Get(XForwardedHostKey))
+	assert.Equal(t, []string{"for=192.0.2.10;host=api.example.com;proto=http"}, md.Get(ForwardedKey))
+}
+
+func TestForwardedHeaders_DoesNotMutateInboundMetadata(t *testing.T) {
+	inMd := metadata.Pairs(XForwardedForKey, "1.2.3.4")
+	ctx := forwardedTestContext("192.0.2.10", nil, inMd)
+	ForwardedHeaders{}.appendTo(ctx, ctx)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	assert.Equal(t, []string{"1.2.3.4"}, md.Get(XForwardedForKey))
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// FrameDirection is the direction in which a message travels through the proxy.
+type FrameDirection int
+
+const (
+	// ClientToBackend marks messages sent by the client of the proxy, forwarded to the backend.
+	ClientToBackend FrameDirection = iota
+	// BackendToClient marks messages sent by the backend, forwarded to the client of the proxy.
+	BackendToClient
+)
+
+func (d FrameDirection) String() string {
+	switch d {
+	case ClientToBackend:
+		return "client_to_backend"
+	case BackendToClient:
+		return "backend_to_client"
+	}
+	return "unknown"
+}
+
+// FrameInfo describes a single message forwarded by the proxy.
+type FrameInfo struct {
+	// FullMethod is the full RPC method string, i.e., /package.service/method.
+	FullMethod string
+	// Direction is the direction the message travels in.
+	Direction FrameDirection
+	// Index is the zero-based position of the message within its direction of the stream. Dropped messages are
+	// counted too.
+	Index int
+}
+
+// ErrDropFrame can be returned by a FrameInterceptor to silently skip forwarding of a message.
+var ErrDropFrame = errors.New("proxy: drop frame")
+
+// FrameInterceptor is invoked for every message forwarded by the proxy, in both directions.
+//
+// The interceptor receives the context of the inbound call and the raw, serialized message. It returns the payload
+// to be forwarded instead, which can be the original payload to pass the message on unchanged. Returning
+// ErrDropFrame, or an error wrapping it, skips the message, while any other error aborts the whole stream and is
+// returned to the client. Such errors should be created with the `status` package.
+//
+// The payload is owned by the interceptor and can be retained.
+type FrameInterceptor func(ctx context.Context, info *FrameInfo, payload []byte) ([]byte, error)
+
+// WithFrameInterceptors adds FrameInterceptors invoked for every forwarded message. They are executed in the order
+// given, each one receiving the payload returned by the previous one.
+func WithFrameInterceptors(interceptors ...FrameInterceptor) HandlerOption {
+	return func(o *handlerOptions) {
+		o.frameInterceptors = append(o.frameInterceptors, interceptors...)
+	}
+}
+
+// frameAbortError marks an error returned by a FrameInterceptor, which has to reach the client as is.
+type frameAbortError struct {
+	err error
+}
+
+func (e *frameAbortError) Error() string {
+	return e.err.Error()
+}
+
+func (e *frameAbortError) Unwrap() error {
+	return e.err
+}
+
+// interceptFrame runs the FrameInterceptors over the message in f, replacing its contents. It returns false if the
+// message is to be dropped.
+func (o *handlerOptions) interceptFrame(ctx context.Context, info *FrameInfo, f *emptypb.Empty) (bool, error) {
+	if len(o.frameInterceptors) == 0 {
+		return true, nil
+	}
+	// The message is decoded into emptypb.Empty, so all of its fields are retained as unknown ones.
+	payload := f.ProtoReflect().GetUnknown()
+	for _, interceptor := range o.frameInterceptors {
+		out, err := interceptor(ctx, info, payload)
+		if errors.Is(err, ErrDropFrame) {
+			return false, nil
+		} else if err != nil {
+			return false, &frameAbortError{err}
+		}
+		payload = out
+	}
+	f.ProtoReflect().SetUnknown(payload)
+	return true, nil
+}
@@ -0,0 +1,114 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+func TestFrameInterceptor_SeesAllFrames(t *testing.T) {
+	var mu sync.Mutex
+	var seen []proxy.FrameInfo
+	client := proxyTestClient(t, nil, proxy.WithFrameInterceptors(func(ctx context.Context, info *proxy.FrameInfo, payload []byte) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, *info)
+		return payload, nil
+	}))
+
+	stream, err := client.PingList(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, seen, 11, "one request and ten responses")
+	assert.Equal(t, proxy.FrameInfo{FullMethod: "/mwitkow.testproto.TestService/PingList", Direction: proxy.ClientToBackend}, seen[0])
+	for i, info := range seen[1:] {
+		assert.Equal(t, proxy.BackendToClient, info.Direction)
+		assert.Equal(t, i, info.Index)
+	}
+}
+
+func TestFrameInterceptor_ReplacesFrames(t *testing.T) {
+	client := proxyTestClient(t, nil, proxy.WithFrameInterceptors(func(ctx context.Context, info *proxy.FrameInfo, payload []byte) ([]byte, error) {
+		if info.Direction != proxy.ClientToBackend {
+			return payload, nil
+		}
+		req := &testservice.PingRequest{}
+		if err := proto.Unmarshal(payload, req); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad request: %v", err)
+		}
+		req.Value = "[redacted]"
+		return proto.Marshal(req)
+	}))
+
+	resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "[redacted]", resp.Value)
+}
+
+func TestFrameInterceptor_DropsFrames(t *testing.T) {
+	for name, drop := range map[string]error{
+		"sentinel": proxy.ErrDropFrame,
+		"wrapped":  fmt.Errorf("odd response: %w", proxy.ErrDropFrame),
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := proxyTestClient(t, nil, proxy.WithFrameInterceptors(func(ctx context.Context, info *proxy.FrameInfo, payload []byte) ([]byte, error) {
+				if info.Direction == proxy.BackendToClient && info.Index%2 == 1 {
+					return nil, drop
+				}
+				return payload, nil
+			}))
+
+			stream, err := client.PingList(context.Background(), &testservice.PingRequest{Value: "hello"})
+			require.NoError(t, err)
+			var counters []int32
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				counters = append(counters, resp.Counter)
+			}
+			assert.Equal(t, []int32{0, 2, 4, 6, 8}, counters)
+		})
+	}
+}
+
+func TestFrameInterceptor_AbortsStream(t *testing.T) {
+	for _, direction := range []proxy.FrameDirection{proxy.ClientToBackend, proxy.BackendToClient} {
+		t.Run(direction.String(), func(t *testing.T) {
+			client := proxyTestClient(t, nil, proxy.WithFrameInterceptors(func(ctx context.Context, info *proxy.FrameInfo, payload []byte) ([]byte, error) {
+				if info.Direction == direction {
+					return nil, status.Errorf(codes.ResourceExhausted, "frame too large")
+				}
+				return payload, nil
+			}))
+
+			_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+			require.Error(t, err)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+			assert.Equal(t, "frame too large", status.Convert(err).Message())
+		})
+	}
+}
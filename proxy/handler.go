@@ -5,7 +5,9 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -23,7 +25,13 @@ var (
 // RegisterService sets up a proxy handler for a particular gRPC service and method.
 // The behaviour is the same as if you were registering a handler method, e.g. from a generated pb.go file.
 func RegisterService(server *grpc.Server, director StreamDirector, serviceName string, methodNames ...string) {
-	streamer := &handler{director}
+	RegisterServiceWithOptions(server, director, serviceName, methodNames)
+}
+
+// RegisterServiceWithOptions is like RegisterService, but allows the proxy handler to be configured with
+// HandlerOptions.
+func RegisterServiceWithOptions(server *grpc.Server, director StreamDirector, serviceName string, methodNames []string, opts ...HandlerOption) {
+	streamer := newHandler(director, opts)
 	fakeDesc := &grpc.ServiceDesc{
 		ServiceName: serviceName,
 		HandlerType: (*interface{})(nil),
@@ -43,13 +51,20 @@ func RegisterService(server *grpc.Server, director StreamDirector, serviceName s
 // TransparentHandler returns a handler that attempts to proxy all requests that are not registered in the server.
 // The indented use here is as a transparent proxy, where the server doesn't know about the services implemented by the
 // backends. It should be used as a `grpc.UnknownServiceHandler`.
-func TransparentHandler(director StreamDirector) grpc.StreamHandler {
-	streamer := &handler{director: director}
+//
+// The handler can be configured with HandlerOptions.
+func TransparentHandler(director StreamDirector, opts ...HandlerOption) grpc.StreamHandler {
+	streamer := newHandler(director, opts)
 	return streamer.handler
 }
 
 type handler struct {
 	director StreamDirector
+	opts     *handlerOptions
+}
+
+func newHandler(director StreamDirector, opts []HandlerOption) *handler {
+	return &handler{director: director, opts: evaluateOptions(opts)}
 }
 
 // handler is where the real magic of proxying happens.
@@ -61,24 +76,192 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 	if !ok {
 		return status.Errorf(codes.Internal, "lowLevelServerStream not exists in context")
 	}
-	// We require that the director's returned context inherits from the serverStream.Context().
-	outgoingCtx, backendConn, err := s.director(serverStream.Context(), fullMethodName)
+	ctx, info := newStreamInfo(serverStream.Context(), fullMethodName)
+	if s.opts.capture != nil {
+		// Wrapped first, so that the capture records what the client sees. It is started before request IDs are
+		// assigned, so the metadata it records is the one of the client, and generated IDs only show in the headers.
+		serverStream = s.opts.capture.start(ctx, serverStream, info)
+	}
+	if s.opts.requestIDs != nil {
+		ctx, serverStream = s.opts.requestIDs.assign(ctx, serverStream)
+	}
+	if s.opts.accessLog != nil {
+		// Registered early, so that the record is written once everything but the capture, which writes its session
+		// last, is done with the call.
+		s.opts.accessLog.observe(ctx, info)
+	}
+	if s.opts.metrics != nil {
+		s.opts.metrics.observe(info)
+	}
+	if s.opts.tracing != nil {
+		ctx = s.opts.tracing.startCall(ctx, info)
+	}
+	err := toStatusError(s.proxy(ctx, serverStream, fullMethodName))
+	if s.opts.errorMapper != nil {
+		err = s.opts.errorMapper(ctx, fullMethodName, err)
+	}
+	info.finish(err)
+	return err
+}
+
+// proxy forwards the call on serverStream to the backend picked by the director and returns its outcome. The ctx is
+// the context of serverStream, carrying the StreamInfo of the call.
+func (s *handler) proxy(ctx context.Context, serverStream grpc.ServerStream, fullMethodName string) error {
+	if s.opts.mirror != nil {
+		serverStream = s.opts.mirror.tee(ctx, serverStream, fullMethodName, s.opts)
+	}
+	if policy := s.opts.hedgingPolicy(fullMethodName); policy != nil {
+		return s.proxyWithHedging(ctx, serverStream, fullMethodName, policy)
+	}
+	if policy := s.opts.retryPolicy(fullMethodName); policy != nil {
+		return s.proxyWithRetries(ctx, serverStream, fullMethodName, policy)
+	}
+	b, err := s.openBackend(ctx, fullMethodName, 0)
 	if err != nil {
 		return err
 	}
+	err = b.explain(s.forward(ctx, serverStream, b.stream, fullMethodName, b.activity, func() { b.cancel(nil) }))
+	b.close()
+	// The attempt is reported with the error of the backend, not the one mapped for the client.
+	b.finish(err)
+	return err
+}
 
-	clientCtx, clientCancel := context.WithCancel(outgoingCtx)
-	defer clientCancel()
-	// TODO(mwitkow): Add a `forwarded` header to metadata, https://en.wikipedia.org/wiki/X-Forwarded-For.
-	clientStream, err := backendConn.NewStream(clientCtx, clientStreamDescForProxying, fullMethodName)
+// backendStream is a stream opened to the backend picked by the director for one attempt of a call.
+type backendStream struct {
+	stream   grpc.ClientStream
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	activity *streamActivity
+	// finishers report the outcome of the attempt, to the director, the circuit breakers and tracing.
+	finishers []func(err error)
+	// record reports the outcome of the attempt to outlier detection, if the backend is what it depends on.
+	record  func(err error)
+	cleanup func()
+}
+
+// openBackend asks the director for the backend of the call and opens a stream to it. Attempts after the first one
+// carry the number of previous attempts in their metadata.
+func (s *handler) openBackend(ctx context.Context, fullMethodName string, attempt int) (*backendStream, error) {
+	// We require that the director's returned context inherits from the serverStream.Context().
+	directorCtx, endDirectorSpan := ctx, func(error) {}
+	if s.opts.tracing != nil {
+		directorCtx, endDirectorSpan = s.opts.tracing.startDirector(ctx)
+	}
+	start := time.Now()
+	outgoingCtx, backendConn, err := s.director(directorCtx, fullMethodName)
+	if s.opts.metrics != nil {
+		s.opts.metrics.observeDirector(fullMethodName, time.Since(start), err)
+	}
+	endDirectorSpan(err)
+	b := &backendStream{}
+	info, hasInfo := StreamInfoFromContext(ctx)
+	if hasInfo {
+		// What the director holds for the attempt, such as the calls in flight counted by a Balancer, ends with it.
+		b.finishers = info.takeAttemptFuncs()
+	}
 	if err != nil {
-		return err
+		b.finish(err)
+		return nil, err
+	}
+	if hasInfo && s.opts.breakers != nil && info.Backend() != "" {
+		release, err := s.opts.breakers.admit(ctx, info.Backend(), fullMethodName)
+		if err != nil {
+			b.finish(err)
+			return nil, err
+		}
+		b.finishers = append(b.finishers, release)
+	}
+	if s.opts.tracing != nil {
+		var endSpan func(err error)
+		outgoingCtx, endSpan = s.opts.tracing.startBackend(ctx, outgoingCtx, fullMethodName, backendConn)
+		b.finishers = append(b.finishers, endSpan)
+	}
+	if s.opts.forwarded != nil {
+		outgoingCtx = s.opts.forwarded.appendTo(ctx, outgoingCtx)
+	}
+	outgoingCtx = withRequestID(ctx, outgoingCtx)
+	if attempt > 0 {
+		outgoingCtx = withPreviousAttempts(ctx, outgoingCtx, attempt)
+	}
+	outgoingCtx, timeoutCancel, err := s.opts.applyTimeout(outgoingCtx, fullMethodName)
+	if err != nil {
+		b.finish(err)
+		return nil, err
+	}
+	b.ctx, b.cancel = context.WithCancelCause(outgoingCtx)
+	b.cleanup = func() {
+		b.cancel(nil)
+		timeoutCancel()
+	}
+	attemptStart := time.Now()
+	b.stream, err = s.opts.newClientStream(b.ctx, backendConn, fullMethodName)
+	if err != nil {
+		b.cleanup()
+		b.finish(err)
+		return nil, err
+	}
+	if hasInfo && s.opts.outliers != nil && info.Backend() != "" {
+		backend := info.Backend()
+		// Recorded with the error of the backend, before it is mapped, so that the detector judges it by what it returned.
+		b.record = func(err error) {
+			s.opts.outliers.Record(backend, time.Since(attemptStart), err)
+		}
+	}
+	b.activity = newStreamActivity()
+	if s.opts.idleTimeout > 0 || len(s.opts.stallTimeouts) > 0 {
+		go s.opts.watchActivity(b.ctx, b.activity, b.cancel)
+	}
+	return b, nil
+}
+
+// explain returns the reason the stream was cancelled with, if err comes from such a cancellation.
+func (b *backendStream) explain(err error) error {
+	if cause := context.Cause(b.ctx); err != nil && cause != nil {
+		// The stream may have been cancelled by the activity watchdog, whose explanation beats a generic cancellation.
+		if _, ok := status.FromError(cause); ok {
+			return cause
+		}
+	}
+	return err
+}
+
+// finish reports the outcome of the attempt.
+func (b *backendStream) finish(err error) {
+	if b.record != nil && b.fromBackend(err) {
+		b.record(toStatusError(err))
+	}
+	err = toStatusError(err)
+	for _, f := range b.finishers {
+		f(err)
+	}
+}
+
+// fromBackend tells whether err, ending the attempt, is the outcome of the backend. Cancellations, frame aborts and
+// the deadlines and watchdogs of the proxy end attempts regardless of the backend.
+func (b *backendStream) fromBackend(err error) bool {
+	if _, ok := err.(*frameAbortError); ok || status.Code(toStatusError(err)) == codes.Canceled {
+		return false
+	}
+	if cause := context.Cause(b.ctx); cause != nil {
+		if _, ok := status.FromError(cause); ok {
+			return false
+		}
 	}
+	return !errors.Is(b.ctx.Err(), context.DeadlineExceeded)
+}
+
+func (b *backendStream) close() {
+	b.cleanup()
+}
+
+// forward pumps messages between serverStream and clientStream in both directions until the call ends.
+func (s *handler) forward(ctx context.Context, serverStream grpc.ServerStream, clientStream grpc.ClientStream, fullMethodName string, activity *streamActivity, clientCancel func()) error {
 	// Explicitly *do not close* s2cErrChan and c2sErrChan, otherwise the select below will not terminate.
 	// Channels do not have to be closed, it is just a control flow mechanism, see
 	// https://groups.google.com/forum/#!msg/golang-nuts/pZwdYRGxCIk/qpbHxRRPJdUJ
-	s2cErrChan := s.forwardServerToClient(serverStream, clientStream)
-	c2sErrChan := s.forwardClientToServer(clientStream, serverStream)
+	s2cErrChan := s.forwardServerToClient(ctx, serverStream, clientStream, fullMethodName, activity)
+	c2sErrChan := s.forwardClientToServer(ctx, clientStream, serverStream, fullMethodName, activity)
 	// We don't know which side is going to stop sending first, so we need a select between the two.
 	for i := 0; i < 2; i++ {
 		select {
@@ -92,9 +275,19 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 				// to cancel the clientStream to the backend, let all of its goroutines be freed up by the CancelFunc and
 				// exit with an error to the stack
 				clientCancel()
-				return status.Errorf(codes.Internal, "failed proxying s2c: %v", s2cErr)
+				if _, ok := s2cErr.(*frameAbortError); !ok {
+					// Once the backend stream is torn down its trailers can be read safely, and forwarded if present.
+					<-c2sErrChan
+					serverStream.SetTrailer(clientStream.Trailer())
+				}
+				return s2cErr
 			}
 		case c2sErr := <-c2sErrChan:
+			if _, ok := c2sErr.(*frameAbortError); ok {
+				// The backend stream is still running, so its trailers are not final and must not be forwarded.
+				clientCancel()
+				return c2sErr
+			}
 			// This happens when the clientStream has nothing else to offer (io.EOF), returned a gRPC error. In those two
 			// cases we may have received Trailers as part of the call. In case of other errors (stream closed) the trailers
 			// will be nil.
@@ -109,16 +302,21 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 	return status.Errorf(codes.Internal, "gRPC proxying should never reach this stage.")
 }
 
-func (s *handler) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream) chan error {
+func (s *handler) forwardClientToServer(ctx context.Context, src grpc.ClientStream, dst grpc.ServerStream, fullMethodName string, activity *streamActivity) chan error {
 	ret := make(chan error, 1)
+	streamInfo, _ := StreamInfoFromContext(ctx)
+	counter := s.opts.metrics.messageCounter(streamInfo, BackendToClient)
 	go func() {
+		defer activity.done(BackendToClient)
 		f := &emptypb.Empty{}
 		for i := 0; ; i++ {
 			if err := src.RecvMsg(f); err != nil {
 				ret <- err // this can be io.EOF which is happy case
 				break
 			}
+			activity.touch(BackendToClient)
 			if i == 0 {
+				streamInfo.markFirstResponse(time.Now())
 				// This is a bit of a hack, but client to server headers are only readable after first client msg is
 				// received but must be written to server stream before the first msg is flushed.
 				// This is the only place to do it nicely.
@@ -132,28 +330,56 @@ func (s *handler) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerSt
 					break
 				}
 			}
+			info := &FrameInfo{FullMethod: fullMethodName, Direction: BackendToClient, Index: i}
+			forward, err := s.opts.interceptFrame(ctx, info, f)
+			if err != nil {
+				ret <- err
+				break
+			}
+			if !forward {
+				continue
+			}
 			if err := dst.SendMsg(f); err != nil {
 				ret <- err
 				break
 			}
+			size := len(f.ProtoReflect().GetUnknown())
+			streamInfo.countMessage(BackendToClient, size)
+			counter.add(size)
 		}
 	}()
 	return ret
 }
 
-func (s *handler) forwardServerToClient(src grpc.ServerStream, dst grpc.ClientStream) chan error {
+func (s *handler) forwardServerToClient(ctx context.Context, src grpc.ServerStream, dst grpc.ClientStream, fullMethodName string, activity *streamActivity) chan error {
 	ret := make(chan error, 1)
+	streamInfo, _ := StreamInfoFromContext(ctx)
+	counter := s.opts.metrics.messageCounter(streamInfo, ClientToBackend)
 	go func() {
+		defer activity.done(ClientToBackend)
 		f := &emptypb.Empty{}
 		for i := 0; ; i++ {
 			if err := src.RecvMsg(f); err != nil {
 				ret <- err // this can be io.EOF which is happy case
 				break
 			}
+			activity.touch(ClientToBackend)
+			info := &FrameInfo{FullMethod: fullMethodName, Direction: ClientToBackend, Index: i}
+			forward, err := s.opts.interceptFrame(ctx, info, f)
+			if err != nil {
+				ret <- err
+				break
+			}
+			if !forward {
+				continue
+			}
 			if err := dst.SendMsg(f); err != nil {
 				ret <- err
 				break
 			}
+			size := len(f.ProtoReflect().GetUnknown())
+			streamInfo.countMessage(ClientToBackend, size)
+			counter.add(size)
 		}
 	}()
 	return ret
@@ -0,0 +1,349 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthChecker actively checks the health of backends using the grpc.health.v1.Health service, per backend and per
+// service name.
+//
+// Its ServiceHealthy method can be given to WithBalancerServiceHealth, WithRouterServiceHealth or
+// WithStickyServiceHealth, so that directors skip backends unhealthy for the service of a call.
+type HealthChecker struct {
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	watch              bool
+	onChange           func(HealthStatus)
+
+	mu      sync.Mutex
+	targets map[string]map[string]*healthTarget
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// HealthStatus is the health of one service of a backend, as observed by a HealthChecker.
+type HealthStatus struct {
+	Backend string
+	// Service is the checked service name, empty for the backend server as a whole.
+	Service string
+	// Healthy is the state used for routing, which only changes after enough consecutive results agree.
+	Healthy bool
+	// Status is the result of the last check, UNKNOWN if it failed.
+	Status healthpb.HealthCheckResponse_ServingStatus
+	// LastError is the error of the last check, nil if it returned a status.
+	LastError error
+	// LastCheck is the time of the last result, zero if there has been none yet.
+	LastCheck time.Time
+	// ConsecutiveSuccesses and ConsecutiveFailures count the results since the last one of the other kind.
+	ConsecutiveSuccesses int
+	ConsecutiveFailures  int
+}
+
+type healthTarget struct {
+	status HealthStatus
+	cancel context.CancelFunc
+}
+
+// HealthCheckOption configures a HealthChecker.
+type HealthCheckOption func(*HealthChecker)
+
+// WithHealthInterval sets the time between two checks of a service, 5 seconds by default. It must be positive.
+func WithHealthInterval(d time.Duration) HealthCheckOption {
+	return func(h *HealthChecker) {
+		h.interval = d
+	}
+}
+
+// WithHealthTimeout sets the timeout of a single check, 1 second by default. It must be positive.
+func WithHealthTimeout(d time.Duration) HealthCheckOption {
+	return func(h *HealthChecker) {
+		h.timeout = d
+	}
+}
+
+// WithHealthThresholds sets the number of consecutive successful checks needed to consider an unhealthy service
+// healthy again, 2 by default, and of consecutive failed checks needed to consider a healthy one unhealthy, 3 by
+// default. Both must be at least 1.
+func WithHealthThresholds(healthy, unhealthy int) HealthCheckOption {
+	return func(h *HealthChecker) {
+		h.healthyThreshold = healthy
+		h.unhealthyThreshold = unhealthy
+	}
+}
+
+// WithHealthWatch makes the checker use the streaming Watch method instead of polling Check, so that changes are
+// noticed as soon as the backend reports them. Every status received counts as one check result, and the last one
+// counts again every interval until the next one arrives. A failed watch is started again after the interval.
+func WithHealthWatch() HealthCheckOption {
+	return func(h *HealthChecker) {
+		h.watch = true
+	}
+}
+
+// WithHealthChangeCallback sets a function called whenever a service becomes healthy or unhealthy. It may be called
+// concurrently for different services.
+func WithHealthChangeCallback(f func(HealthStatus)) HealthCheckOption {
+	return func(h *HealthChecker) {
+		h.onChange = f
+	}
+}
+
+// NewHealthChecker creates a HealthChecker without any backends, or returns an error if the options are invalid. It
+// must be closed with Close when no longer needed.
+func NewHealthChecker(opts ...HealthCheckOption) (*HealthChecker, error) {
+	h := &HealthChecker{
+		interval:           5 * time.Second,
+		timeout:            time.Second,
+		healthyThreshold:   2,
+		unhealthyThreshold: 3,
+		targets:            make(map[string]map[string]*healthTarget),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	switch {
+	case h.interval <= 0:
+		return nil, fmt.Errorf("proxy: health check interval must be positive, got %v", h.interval)
+	case h.timeout <= 0:
+		return nil, fmt.Errorf("proxy: health check timeout must be positive, got %v", h.timeout)
+	case h.healthyThreshold < 1 || h.unhealthyThreshold < 1:
+		return nil, fmt.Errorf("proxy: health thresholds must be at least 1, got %d and %d", h.healthyThreshold, h.unhealthyThreshold)
+	}
+	return h, nil
+}
+
+// Add starts checking the given services of a backend over cc, or the backend server as a whole if no service is
+// given. Services already checked for the backend are checked over cc from now on.
+//
+// The first result of a service decides its state, later changes need the configured number of consecutive results.
+// Services are considered healthy until their first result.
+func (h *HealthChecker) Add(backend string, cc grpc.ClientConnInterface, services ...string) {
+	if len(services) == 0 {
+		services = []string{""}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	if h.targets[backend] == nil {
+		h.targets[backend] = make(map[string]*healthTarget)
+	}
+	for _, service := range services {
+		if old, ok := h.targets[backend][service]; ok {
+			old.cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t := &healthTarget{status: HealthStatus{Backend: backend, Service: service, Healthy: true}, cancel: cancel}
+		h.targets[backend][service] = t
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			if h.watch {
+				h.watchLoop(ctx, t, healthpb.NewHealthClient(cc))
+			} else {
+				h.checkLoop(ctx, t, healthpb.NewHealthClient(cc))
+			}
+		}()
+	}
+}
+
+// Remove stops checking the given services of a backend, or all of them if no service is given.
+func (h *HealthChecker) Remove(backend string, services ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(services) == 0 {
+		for service := range h.targets[backend] {
+			services = append(services, service)
+		}
+	}
+	for _, service := range services {
+		if t, ok := h.targets[backend][service]; ok {
+			t.cancel()
+			delete(h.targets[backend], service)
+		}
+	}
+	if len(h.targets[backend]) == 0 {
+		delete(h.targets, backend)
+	}
+}
+
+// Healthy reports whether a backend server as a whole, checked with the empty service name, is healthy. Services
+// checked by name do not affect it, see ServiceHealthy. Backends that are not checked are healthy.
+func (h *HealthChecker) Healthy(backend string) bool {
+	return h.ServiceHealthy(backend, "")
+}
+
+// ServiceHealthy reports whether a service of a backend is healthy, which needs the backend server as a whole to be
+// healthy too. Services that are not checked are healthy.
+func (h *HealthChecker) ServiceHealthy(backend, service string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, name := range []string{"", service} {
+		if t, ok := h.targets[backend][name]; ok && !t.status.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the health of all checked services, ordered by backend and service.
+func (h *HealthChecker) Status() []HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var statuses []HealthStatus
+	for _, services := range h.targets {
+		for _, t := range services {
+			statuses = append(statuses, t.status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Backend != statuses[j].Backend {
+			return statuses[i].Backend < statuses[j].Backend
+		}
+		return statuses[i].Service < statuses[j].Service
+	})
+	return statuses
+}
+
+// Close stops all checks and waits for them to return. Further calls to Add are ignored.
+func (h *HealthChecker) Close() {
+	h.mu.Lock()
+	h.closed = true
+	for backend, services := range h.targets {
+		for _, t := range services {
+			t.cancel()
+		}
+		delete(h.targets, backend)
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+}
+
+func (h *HealthChecker) checkLoop(ctx context.Context, t *healthTarget, client healthpb.HealthClient) {
+	req := &healthpb.HealthCheckRequest{Service: t.status.Service}
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+		resp, err := client.Check(checkCtx, req)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		h.record(t, resp.GetStatus(), err)
+		if !sleepContext(ctx, h.interval) {
+			return
+		}
+	}
+}
+
+func (h *HealthChecker) watchLoop(ctx context.Context, t *healthTarget, client healthpb.HealthClient) {
+	req := &healthpb.HealthCheckRequest{Service: t.status.Service}
+	for {
+		stream, err := client.Watch(ctx, req)
+		if err == nil {
+			err = h.followWatch(ctx, t, stream)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		h.record(t, healthpb.HealthCheckResponse_UNKNOWN, err)
+		if !sleepContext(ctx, h.interval) {
+			return
+		}
+	}
+}
+
+// followWatch records the statuses received on stream until it fails, and returns its error.
+func (h *HealthChecker) followWatch(ctx context.Context, t *healthTarget, stream healthpb.Health_WatchClient) error {
+	recv := make(chan healthpb.HealthCheckResponse_ServingStatus)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case recv <- resp.GetStatus():
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	last, received := healthpb.HealthCheckResponse_UNKNOWN, false
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case last = <-recv:
+			received = true
+			h.record(t, last, nil)
+			ticker.Reset(h.interval)
+		case <-ticker.C:
+			if received {
+				h.record(t, last, nil)
+			}
+		}
+	}
+}
+
+// record applies the result of one check of t.
+func (h *HealthChecker) record(t *healthTarget, status healthpb.HealthCheckResponse_ServingStatus, err error) {
+	h.mu.Lock()
+	s := &t.status
+	first := s.LastCheck.IsZero()
+	s.Status, s.LastError, s.LastCheck = status, err, time.Now()
+	serving := err == nil && status == healthpb.HealthCheckResponse_SERVING
+	if serving {
+		s.ConsecutiveSuccesses++
+		s.ConsecutiveFailures = 0
+	} else {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+	}
+	changed := false
+	switch {
+	case first:
+		changed = s.Healthy != serving
+	case serving && !s.Healthy:
+		changed = s.ConsecutiveSuccesses >= h.healthyThreshold
+	case !serving && s.Healthy:
+		changed = s.ConsecutiveFailures >= h.unhealthyThreshold
+	}
+	if changed {
+		s.Healthy = serving
+	}
+	snapshot := *s
+	h.mu.Unlock()
+	if changed && h.onChange != nil {
+		h.onChange(snapshot)
+	}
+}
+
+// sleepContext waits for d and reports whether ctx is still not done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,208 @@
+package proxy_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+)
+
+// healthBackend serves a health service and returns it with a connection to it.
+func healthBackend(t *testing.T) (*health.Server, *grpc.ClientConn) {
+	t.Helper()
+	srv := health.NewServer()
+	grpcSrv := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcSrv, srv)
+	cc, err := serverDialer(t, grpcSrv)
+	require.NoError(t, err)
+	return srv, cc
+}
+
+func TestHealthChecker_Hysteresis(t *testing.T) {
+	for _, watch := range []bool{false, true} {
+		name := "check"
+		if watch {
+			name = "watch"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv, cc := healthBackend(t)
+			srv.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+
+			var mu sync.Mutex
+			var changes []proxy.HealthStatus
+			opts := []proxy.HealthCheckOption{
+				proxy.WithHealthInterval(5 * time.Millisecond),
+				proxy.WithHealthThresholds(1, 2),
+				proxy.WithHealthChangeCallback(func(s proxy.HealthStatus) {
+					mu.Lock()
+					defer mu.Unlock()
+					changes = append(changes, s)
+				}),
+			}
+			if watch {
+				opts = append(opts, proxy.WithHealthWatch())
+			}
+			h, err := proxy.NewHealthChecker(opts...)
+			require.NoError(t, err)
+			t.Cleanup(h.Close)
+			h.Add("a", cc, "svc")
+			assert.True(t, h.ServiceHealthy("a", "svc"), "backends are healthy until checked")
+
+			require.Eventually(t, func() bool { return !h.Status()[0].LastCheck.IsZero() }, time.Second, time.Millisecond)
+			assert.True(t, h.ServiceHealthy("a", "svc"))
+
+			srv.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+			require.Eventually(t, func() bool { return !h.ServiceHealthy("a", "svc") }, time.Second, time.Millisecond)
+			assert.True(t, h.Healthy("a"), "other services are not affected")
+			srv.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+			require.Eventually(t, func() bool { return h.ServiceHealthy("a", "svc") }, time.Second, time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Len(t, changes, 2)
+			assert.False(t, changes[0].Healthy)
+			assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, changes[0].Status)
+			assert.Equal(t, 2, changes[0].ConsecutiveFailures, "becoming unhealthy needs two failures")
+			assert.True(t, changes[1].Healthy)
+		})
+	}
+}
+
+func TestHealthChecker_StatusAndRemove(t *testing.T) {
+	srv, cc := healthBackend(t)
+	srv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	h, err := proxy.NewHealthChecker(proxy.WithHealthInterval(5 * time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(h.Close)
+	h.Add("b", cc)
+	h.Add("a", cc, "", "missing")
+
+	require.Eventually(t, func() bool {
+		for _, s := range h.Status() {
+			if s.LastCheck.IsZero() {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	statuses := h.Status()
+	require.Len(t, statuses, 3)
+	assert.Equal(t, []string{"a", "a", "b"}, []string{statuses[0].Backend, statuses[1].Backend, statuses[2].Backend})
+	assert.Equal(t, []string{"", "missing", ""}, []string{statuses[0].Service, statuses[1].Service, statuses[2].Service})
+	assert.Equal(t, codes.NotFound, status.Code(statuses[1].LastError), "the first result decides the state")
+	assert.False(t, statuses[1].Healthy)
+	assert.False(t, h.ServiceHealthy("a", "missing"))
+	assert.True(t, h.Healthy("a"), "services checked by name do not affect the backend as a whole")
+	assert.True(t, h.ServiceHealthy("a", "other"))
+	assert.True(t, h.Healthy("b"))
+	assert.True(t, h.Healthy("unknown"))
+
+	h.Remove("a", "missing")
+	assert.True(t, h.ServiceHealthy("a", "missing"))
+	h.Remove("a")
+	assert.Len(t, h.Status(), 1)
+}
+
+func TestHealthChecker_InvalidOptions(t *testing.T) {
+	for _, opt := range []proxy.HealthCheckOption{
+		proxy.WithHealthInterval(0),
+		proxy.WithHealthTimeout(-time.Second),
+		proxy.WithHealthThresholds(0, 3),
+		proxy.WithHealthThresholds(2, -1),
+	} {
+		_, err := proxy.NewHealthChecker(opt)
+		assert.Error(t, err)
+	}
+}
+
+func TestBalancer_Health(t *testing.T) {
+	down := map[string]bool{"b": true}
+	healthy := func(backend string) bool { return !down[backend] }
+	for _, policy := range []proxy.BalancingPolicy{proxy.RoundRobin, proxy.LeastOutstanding, proxy.RandomTwoChoices} {
+		t.Run(string(policy), func(t *testing.T) {
+			b, err := proxy.NewBalancer(policy, []string{"a", "b", "c"}, proxy.WithBalancerHealth(healthy))
+			require.NoError(t, err)
+			counts := pickN(t, b, 20)
+			assert.Zero(t, counts["b"])
+			assert.Equal(t, 20, counts["a"]+counts["c"])
+		})
+	}
+
+	b, err := proxy.NewBalancer(proxy.RoundRobin, []string{"b"}, proxy.WithBalancerHealth(healthy))
+	require.NoError(t, err)
+	_, err = b.Pick(context.Background())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// The service of a call is taken from the server stream of its context.
+	b, err = proxy.NewBalancer(proxy.RoundRobin, []string{"a", "b"}, proxy.WithBalancerServiceHealth(func(backend, service string) bool {
+		return backend != "b" || service != "pkg.Down"
+	}))
+	require.NoError(t, err)
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), methodStream("/pkg.Down/Method"))
+	for i := 0; i < 4; i++ {
+		backend, err := b.Pick(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "a", backend)
+	}
+	assert.Equal(t, 4, pickN(t, b, 8)["b"], "other services still use b")
+}
+
+// methodStream is a grpc.ServerTransportStream only reporting its method.
+type methodStream string
+
+func (m methodStream) Method() string                { return string(m) }
+func (methodStream) SetHeader(md metadata.MD) error  { return nil }
+func (methodStream) SendHeader(md metadata.MD) error { return nil }
+func (methodStream) SetTrailer(md metadata.MD) error { return nil }
+
+func TestRouter_Health(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(`
+backends:
+  a: {target: a}
+  b: {target: b}
+routes:
+  - match: {method_prefix: "/balanced."}
+    backends: [a, b]
+  - match: {method_prefix: "/single."}
+    backend: b
+`))
+	require.NoError(t, err)
+	router, err := proxy.NewRouter(cfg, nil, proxy.WithRouterHealth(func(backend string) bool { return backend != "b" }))
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		backend, err := router.Match(context.Background(), "/balanced.Service/Method")
+		require.NoError(t, err)
+		assert.Equal(t, "a", backend)
+	}
+	_, err = router.Match(context.Background(), "/single.Service/Method")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Backend b is only unhealthy for the Down services.
+	router, err = proxy.NewRouter(cfg, nil, proxy.WithRouterServiceHealth(func(backend, service string) bool {
+		return backend != "b" || !strings.HasSuffix(service, ".Down")
+	}))
+	require.NoError(t, err)
+	backend, err := router.Match(context.Background(), "/single.Service/Method")
+	require.NoError(t, err)
+	assert.Equal(t, "b", backend)
+	_, err = router.Match(context.Background(), "/single.Down/Method")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	for i := 0; i < 4; i++ {
+		backend, err := router.Match(context.Background(), "/balanced.Down/Method")
+		require.NoError(t, err)
+		assert.Equal(t, "a", backend)
+	}
+}
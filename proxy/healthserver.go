@@ -0,0 +1,145 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// HealthServer implements the grpc.health.v1.Health service on the proxy itself, instead of forwarding health checks
+// to a backend. Register it on the proxy server, which then answers health checks locally:
+//
+//	healthpb.RegisterHealthServer(server, proxy.NewHealthServer(checker, router.ServiceBackends))
+//
+// The status of a service is SERVING if any of the backends it is routed to is healthy, NOT_SERVING if none is, and
+// unknown if it is not routed anywhere. The empty service name reports the proxy as a whole, which is SERVING until it
+// drains. While draining, all services are NOT_SERVING.
+type HealthServer struct {
+	healthpb.UnimplementedHealthServer
+
+	checker  *HealthChecker
+	backends func(service string) []string
+	interval time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	// changed is closed and replaced whenever the drain state changes, to wake up watchers.
+	changed chan struct{}
+}
+
+// HealthServerOption configures a HealthServer.
+type HealthServerOption func(*HealthServer)
+
+// WithHealthServerInterval sets how often the status of watched services is evaluated, 1 second by default. Drain
+// state changes are sent to watchers immediately.
+func WithHealthServerInterval(d time.Duration) HealthServerOption {
+	return func(s *HealthServer) {
+		s.interval = d
+	}
+}
+
+// NewHealthServer creates a HealthServer reporting the health of services from the health of their backends, as
+// returned by backends, e.g. Router.ServiceBackends, and checked by checker. The backends of services routed by a
+// ReloadingRouter are given by its own ServiceBackends, as the ones of its Router change with every reload.
+func NewHealthServer(checker *HealthChecker, backends func(service string) []string, opts ...HealthServerOption) *HealthServer {
+	s := &HealthServer{
+		checker:  checker,
+		backends: backends,
+		interval: time.Second,
+		changed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Drain makes all services report NOT_SERVING, so that load balancers stop sending new calls to the proxy.
+func (s *HealthServer) Drain() {
+	s.setDraining(true)
+}
+
+// Resume ends draining.
+func (s *HealthServer) Resume() {
+	s.setDraining(false)
+}
+
+// Draining reports whether the proxy is draining.
+func (s *HealthServer) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+func (s *HealthServer) setDraining(draining bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining != draining {
+		s.draining = draining
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
+
+// ServingStatus returns the status reported for a service.
+func (s *HealthServer) ServingStatus(service string) healthpb.HealthCheckResponse_ServingStatus {
+	s.mu.Lock()
+	draining := s.draining
+	s.mu.Unlock()
+	switch {
+	case draining:
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	case service == "":
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	backends := s.backends(service)
+	if len(backends) == 0 {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	for _, backend := range backends {
+		if s.checker.ServiceHealthy(backend, service) {
+			return healthpb.HealthCheckResponse_SERVING
+		}
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// Check implements grpc.health.v1.Health/Check. Unknown services fail with NotFound.
+func (s *HealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	st := s.ServingStatus(req.GetService())
+	if st == healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch implements grpc.health.v1.Health/Watch, sending the status of the service whenever it changes.
+func (s *HealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		if st := s.ServingStatus(req.GetService()); st != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+)
+
+const healthServerTestConfig = `
+backends:
+  users-1: {target: users-1}
+  users-2: {target: users-2}
+  orders: {target: orders}
+routes:
+  - match: {method_prefix: "/example.users.v1.Users/"}
+    backends: [users-1, users-2]
+  - match: {method: "/example.orders.v1.Orders/Get"}
+    backend: orders
+  - match: {method_glob: "/example.*.v2.*/*"}
+    backend: orders
+`
+
+func TestRouter_ServiceBackends(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(healthServerTestConfig))
+	require.NoError(t, err)
+	router, err := proxy.NewRouter(cfg, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"users-1", "users-2"}, router.ServiceBackends("example.users.v1.Users"))
+	assert.Equal(t, []string{"orders"}, router.ServiceBackends("example.orders.v1.Orders"))
+	assert.Equal(t, []string{"orders"}, router.ServiceBackends("example.users.v2.Users"))
+	assert.Empty(t, router.ServiceBackends("example.users.v1.Admin"))
+
+	cfg.DefaultBackend = "users-1"
+	router, err = proxy.NewRouter(cfg, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users-1"}, router.ServiceBackends("example.users.v1.Admin"))
+}
+
+func TestReloadingRouter_ServiceBackends(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(healthServerTestConfig))
+	require.NoError(t, err)
+	router, err := proxy.NewReloadingRouter(cfg, nil)
+	require.NoError(t, err)
+	backends := router.ServiceBackends
+	assert.Empty(t, backends("example.users.v1.Admin"))
+
+	cfg.DefaultBackend = "users-1"
+	require.NoError(t, router.Update(cfg))
+	assert.Equal(t, []string{"users-1"}, backends("example.users.v1.Admin"), "reloads must be followed")
+}
+
+func TestHealthServer(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(healthServerTestConfig))
+	require.NoError(t, err)
+	router, err := proxy.NewRouter(cfg, nil)
+	require.NoError(t, err)
+
+	checker, err := proxy.NewHealthChecker(proxy.WithHealthInterval(5*time.Millisecond), proxy.WithHealthThresholds(1, 1))
+	require.NoError(t, err)
+	backends := make(map[string]*health.Server)
+	for _, name := range []string{"users-1", "users-2", "orders"} {
+		srv, cc := healthBackend(t)
+		srv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		backends[name] = srv
+		checker.Add(name, cc)
+	}
+	t.Cleanup(checker.Close)
+
+	hs := proxy.NewHealthServer(checker, router.ServiceBackends, proxy.WithHealthServerInterval(5*time.Millisecond))
+	dst, err := backendDialer(t)
+	require.NoError(t, err)
+	proxySrv := proxy.NewProxy(dst)
+	healthpb.RegisterHealthServer(proxySrv, hs)
+	proxyCC, err := proxyDialer(t, proxySrv)
+	require.NoError(t, err)
+	client := healthpb.NewHealthClient(proxyCC)
+
+	check := func(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		return resp.GetStatus(), err
+	}
+	waitFor := func(service string, want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			st, err := check(service)
+			return err == nil && st == want
+		}, time.Second, time.Millisecond)
+	}
+
+	waitFor("", healthpb.HealthCheckResponse_SERVING)
+	waitFor("example.users.v1.Users", healthpb.HealthCheckResponse_SERVING)
+	_, err = check("example.unknown.Service")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	backends["users-1"].SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	require.Eventually(t, func() bool { return !checker.Healthy("users-1") }, time.Second, time.Millisecond)
+	st, err := check("example.users.v1.Users")
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, st, "one healthy backend is enough")
+	backends["users-2"].SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitFor("example.users.v1.Users", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitFor("example.orders.v1.Orders", healthpb.HealthCheckResponse_SERVING)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: ""})
+	require.NoError(t, err)
+	resp, err := watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	hs.Drain()
+	assert.True(t, hs.Draining())
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	st, err = check("example.orders.v1.Orders")
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, st, "all services must be down while draining")
+
+	hs.Resume()
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+}
@@ -0,0 +1,290 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// HedgingPolicy makes the handler hedge calls to the methods it matches: when the backend has not responded after a
+// delay, the same request is sent to another backend, and the first response is forwarded to the client while the
+// other attempts are cancelled.
+//
+// Hedging is meant for unary, idempotent methods. The whole response of each attempt is received before it is
+// forwarded, and the messages of the client are buffered as for RetryPolicy. Attempts receiving more than one response
+// message fail with Unimplemented, so that streamed responses are not buffered. Hedged attempts prefer backends no other
+// attempt of the call was sent to, see StreamInfo.PreviousBackends.
+type HedgingPolicy struct {
+	// Method is a pattern matched against the full method name, with the same syntax as TimeoutRule.Method.
+	Method string
+	// MaxAttempts is the maximum number of attempts, including the first one. It defaults to 2.
+	MaxAttempts int
+	// Delay is the time after which the next attempt is started, if no attempt has completed yet. It defaults to
+	// 100ms.
+	Delay time.Duration
+	// NonFatalCodes are the status codes of failed attempts that do not end the call, by default only Unavailable.
+	// When an attempt fails with one of them, the next attempt is started without waiting for the delay. Other
+	// failures are forwarded to the client like responses.
+	NonFatalCodes []codes.Code
+	// BufferLimit is the maximum number of bytes of client messages buffered for hedged attempts, 64 KiB by default.
+	BufferLimit int
+}
+
+// WithHedging enables hedging with the given HedgingPolicies. Policies are evaluated in order and only the first
+// policy matching a method applies. Methods with a HedgingPolicy are not retried with a RetryPolicy, but hedged
+// attempts count against the budget set with WithRetryBudget.
+func WithHedging(policies ...HedgingPolicy) HandlerOption {
+	return func(o *handlerOptions) {
+		o.hedging = append(o.hedging, policies...)
+	}
+}
+
+func (o *handlerOptions) hedgingPolicy(fullMethodName string) *HedgingPolicy {
+	for i := range o.hedging {
+		if matchMethod(o.hedging[i].Method, fullMethodName) {
+			return &o.hedging[i]
+		}
+	}
+	return nil
+}
+
+func (p *HedgingPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return 2
+	}
+	return p.MaxAttempts
+}
+
+func (p *HedgingPolicy) delay() time.Duration {
+	if p.Delay == 0 {
+		return 100 * time.Millisecond
+	}
+	return p.Delay
+}
+
+func (p *HedgingPolicy) nonFatal(code codes.Code) bool {
+	if len(p.NonFatalCodes) == 0 {
+		return code == codes.Unavailable
+	}
+	for _, c := range p.NonFatalCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *HedgingPolicy) bufferLimit() int {
+	if p.BufferLimit == 0 {
+		return 64 << 10
+	}
+	return p.BufferLimit
+}
+
+// hedgedAttempt is the complete outcome of one attempt of a hedged call.
+type hedgedAttempt struct {
+	info    *StreamInfo
+	b       *backendStream
+	header  metadata.MD
+	msgs    []*emptypb.Empty
+	trailer metadata.MD
+	err     error
+}
+
+// finish releases the resources of the attempt, reporting err as its outcome.
+func (a *hedgedAttempt) finish(err error) {
+	if a.b != nil {
+		a.b.close()
+		a.b.finish(err)
+	}
+	a.info.finish(err)
+}
+
+// proxyWithHedging forwards the call like proxy, sending it to several backends concurrently.
+func (s *handler) proxyWithHedging(ctx context.Context, serverStream grpc.ServerStream, fullMethodName string, policy *HedgingPolicy) error {
+	buf := newReplayBuffer(policy.bufferLimit())
+	go buf.fill(serverStream)
+	info, _ := StreamInfoFromContext(ctx)
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var backends []string
+	results := make(chan *hedgedAttempt, policy.maxAttempts())
+	launched := 0
+	launch := func() {
+		attemptCtx, attemptInfo := newStreamInfo(hedgeCtx, fullMethodName)
+		mu.Lock()
+		attemptInfo.attempt, attemptInfo.previous = launched, append([]string(nil), backends...)
+		mu.Unlock()
+		launched++
+		go func() {
+			results <- s.hedgedAttempt(attemptCtx, serverStream, buf, attemptInfo, func(backend string) {
+				mu.Lock()
+				defer mu.Unlock()
+				backends = append(backends, backend)
+			})
+		}()
+	}
+	canLaunch := func() bool {
+		return launched < policy.maxAttempts() && buf.replayable() && s.opts.retryBudget.allow()
+	}
+	// last is the latest attempt that failed with a non-fatal error, forwarded if no other attempt completes.
+	var last *hedgedAttempt
+	discardLast := func() {
+		if last == nil {
+			return
+		}
+		last.finish(last.err)
+	}
+
+	launch()
+	timer := time.NewTimer(policy.delay())
+	defer timer.Stop()
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if canLaunch() {
+				launch()
+				pending++
+				timer.Reset(policy.delay())
+			}
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				s.opts.retryBudget.success()
+			} else if policy.nonFatal(status.Code(a.err)) && ctx.Err() == nil && !buf.clientFailed() {
+				s.opts.retryBudget.failure()
+				discardLast()
+				last = a
+				if canLaunch() {
+					launch()
+					pending++
+					timer.Reset(policy.delay())
+				}
+				continue
+			}
+			discardLast()
+			// The other attempts lost and are cancelled.
+			cancel()
+			go func() {
+				for ; pending > 0; pending-- {
+					loser := <-results
+					loser.finish(status.Error(codes.Canceled, "proxy: hedged attempt lost"))
+				}
+			}()
+			return s.commitHedgedAttempt(ctx, serverStream, info, buf, a)
+		}
+	}
+	// All attempts failed without a fatal error, the last one is forwarded.
+	return s.commitHedgedAttempt(ctx, serverStream, info, buf, last)
+}
+
+// hedgedAttempt sends the buffered request of the client to the backend picked by the director and receives the
+// whole response, which must be a single message. The picked backend is reported to picked as soon as it is known.
+func (s *handler) hedgedAttempt(ctx context.Context, serverStream grpc.ServerStream, buf *replayBuffer, info *StreamInfo, picked func(backend string)) *hedgedAttempt {
+	a := &hedgedAttempt{info: info}
+	a.b, a.err = s.openBackend(ctx, info.FullMethod, info.Attempt())
+	if backend := info.Backend(); backend != "" {
+		picked(backend)
+	}
+	if a.err != nil {
+		return a
+	}
+	b := a.b
+
+	src := &replayStream{ServerStream: serverStream, buf: buf, ctx: b.ctx}
+	sendErrChan := s.forwardServerToClient(ctx, src, b.stream, info.FullMethod, b.activity)
+	sendDone := make(chan error, 1)
+	go func() {
+		err := <-sendErrChan
+		if err == io.EOF {
+			b.stream.CloseSend()
+		} else {
+			b.cancel(nil)
+		}
+		sendDone <- err
+	}()
+
+	for i := 0; ; i++ {
+		f := &emptypb.Empty{}
+		err := b.stream.RecvMsg(f)
+		if err != nil {
+			if err != io.EOF {
+				a.err = b.explain(err)
+			}
+			break
+		}
+		b.activity.touch(BackendToClient)
+		if i > 0 {
+			a.err = status.Errorf(codes.Unimplemented, "proxy: hedged call to %s received more than one response message", info.FullMethod)
+			break
+		}
+		info.markFirstResponse(time.Now())
+		if a.header, err = b.stream.Header(); err != nil {
+			a.err = err
+			break
+		}
+		a.msgs = append(a.msgs, f)
+	}
+	b.activity.done(BackendToClient)
+	a.trailer = b.stream.Trailer()
+	b.cancel(nil)
+	if err := <-sendDone; err != io.EOF {
+		if _, ok := err.(*frameAbortError); ok {
+			a.err = err
+		}
+	}
+	return a
+}
+
+// commitHedgedAttempt forwards the response of the attempt a to the client.
+func (s *handler) commitHedgedAttempt(ctx context.Context, serverStream grpc.ServerStream, info *StreamInfo, buf *replayBuffer, a *hedgedAttempt) (err error) {
+	buf.commit()
+	info.SetBackend(a.info.Backend())
+	info.SetGroup(a.info.Group())
+	info.markFirstResponse(a.info.FirstResponse())
+	count, size := a.info.Messages(ClientToBackend)
+	info.messages[ClientToBackend].Add(count)
+	info.bytes[ClientToBackend].Add(size)
+	defer func() { a.finish(err) }()
+	if _, ok := a.err.(*frameAbortError); !ok {
+		serverStream.SetTrailer(a.trailer)
+	}
+	if a.err != nil {
+		return a.err
+	}
+	if len(a.msgs) > 0 {
+		if err := serverStream.SendHeader(a.header); err != nil {
+			return err
+		}
+	}
+	counter := s.opts.metrics.messageCounter(info, BackendToClient)
+	for i, f := range a.msgs {
+		frame := &FrameInfo{FullMethod: info.FullMethod, Direction: BackendToClient, Index: i}
+		forward, err := s.opts.interceptFrame(ctx, frame, f)
+		if err != nil {
+			return err
+		}
+		if !forward {
+			continue
+		}
+		if err := serverStream.SendMsg(f); err != nil {
+			return err
+		}
+		size := len(f.ProtoReflect().GetUnknown())
+		info.countMessage(BackendToClient, size)
+		counter.add(size)
+	}
+	return nil
+}
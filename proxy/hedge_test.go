@@ -0,0 +1,124 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// hangingService never answers, reporting when calls are cancelled.
+type hangingService struct {
+	testservice.TestServiceServer
+	cancelled chan struct{}
+}
+
+func (s *hangingService) Ping(ctx context.Context, _ *testservice.PingRequest) (*testservice.PingResponse, error) {
+	<-ctx.Done()
+	close(s.cancelled)
+	return nil, ctx.Err()
+}
+
+// attemptDirector forwards the attempts of every call to the given backends, the first attempt to the first one and
+// so on. Nil backends are the default test service.
+func attemptDirector(t *testing.T, backends ...testservice.TestServiceServer) proxy.StreamDirector {
+	t.Helper()
+	var conns []*grpc.ClientConn
+	for _, backend := range backends {
+		conns = append(conns, testBackendConn(t, backend))
+	}
+	return func(ctx context.Context, _ string) (context.Context, grpc.ClientConnInterface, error) {
+		info, _ := proxy.StreamInfoFromContext(ctx)
+		md, _ := metadata.FromIncomingContext(ctx)
+		return metadata.NewOutgoingContext(ctx, md.Copy()), conns[info.Attempt()], nil
+	}
+}
+
+func TestHedging_FirstResponseWins(t *testing.T) {
+	hanging := &hangingService{cancelled: make(chan struct{})}
+	client := directedTestClient(t, attemptDirector(t, hanging, nil),
+		proxy.WithHedging(proxy.HedgingPolicy{Delay: 10 * time.Millisecond}))
+
+	header := metadata.MD{}
+	resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	// The test service echoes the metadata it received.
+	assert.Equal(t, []string{"1"}, header.Get("grpc-previous-rpc-attempts"))
+
+	select {
+	case <-hanging.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the losing attempt was not cancelled")
+	}
+}
+
+func TestHedging_NoHedgeBeforeDelay(t *testing.T) {
+	failing := &failingService{err: status.Error(codes.Unavailable, "overloaded")}
+	client := directedTestClient(t, attemptDirector(t, nil, failing),
+		proxy.WithHedging(proxy.HedgingPolicy{Delay: time.Hour}))
+
+	header := metadata.MD{}
+	resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	assert.Empty(t, header.Get("grpc-previous-rpc-attempts"))
+	assert.EqualValues(t, 0, failing.calls.Load())
+}
+
+func TestHedging_NonFatalFailureHedgesImmediately(t *testing.T) {
+	failing := &failingService{err: status.Error(codes.Unavailable, "overloaded")}
+	client := directedTestClient(t, attemptDirector(t, failing, nil),
+		proxy.WithHedging(proxy.HedgingPolicy{Delay: time.Hour}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	assert.EqualValues(t, 1, failing.calls.Load())
+}
+
+func TestHedging_FailuresForwarded(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		backends int
+		calls    int32
+	}{
+		{name: "fatal error", err: status.Error(codes.InvalidArgument, "bad request"), backends: 3, calls: 1},
+		{name: "all attempts failed", err: status.Error(codes.Unavailable, "overloaded"), backends: 3, calls: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failing := &failingService{err: tc.err}
+			var backends []testservice.TestServiceServer
+			for i := 0; i < tc.backends; i++ {
+				backends = append(backends, failing)
+			}
+			client := directedTestClient(t, attemptDirector(t, backends...),
+				proxy.WithHedging(proxy.HedgingPolicy{MaxAttempts: tc.backends, Delay: time.Hour}))
+
+			_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+			assert.Equal(t, status.Code(tc.err), status.Code(err))
+			assert.EqualValues(t, tc.calls, failing.calls.Load())
+		})
+	}
+}
+
+func TestHedging_StreamedResponsesFail(t *testing.T) {
+	client := directedTestClient(t, attemptDirector(t, nil), proxy.WithHedging(proxy.HedgingPolicy{Delay: time.Hour}))
+
+	stream, err := client.PingList(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unimplemented, status.Code(err), "streamed responses must not be buffered")
+}
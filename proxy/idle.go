@@ -0,0 +1,112 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithIdleTimeout cancels proxied streams on which no message was forwarded, in either direction, for longer than d.
+// The client receives a DeadlineExceeded status explaining the cancellation.
+//
+// This reclaims long-lived streams, such as watches, whose peers went away without the connection noticing.
+func WithIdleTimeout(d time.Duration) HandlerOption {
+	return func(o *handlerOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// WithStallTimeout cancels proxied streams on which no message was forwarded in the given direction for longer
+// than d, even if messages keep flowing in the other one. Detection stops once the sender half-closes that direction.
+// The client receives a DeadlineExceeded status explaining the cancellation.
+func WithStallTimeout(direction FrameDirection, d time.Duration) HandlerOption {
+	return func(o *handlerOptions) {
+		if o.stallTimeouts == nil {
+			o.stallTimeouts = make(map[FrameDirection]time.Duration)
+		}
+		o.stallTimeouts[direction] = d
+	}
+}
+
+// streamActivity records when a proxied stream last forwarded a message in each direction.
+type streamActivity struct {
+	// last holds the time of the last message per direction, in Unix nanoseconds.
+	last [2]atomic.Int64
+	// closed marks directions in which no more messages will be sent.
+	closed [2]atomic.Bool
+}
+
+func newStreamActivity() *streamActivity {
+	a := &streamActivity{}
+	now := time.Now().UnixNano()
+	a.last[ClientToBackend].Store(now)
+	a.last[BackendToClient].Store(now)
+	return a
+}
+
+func (a *streamActivity) touch(direction FrameDirection) {
+	a.last[direction].Store(time.Now().UnixNano())
+}
+
+func (a *streamActivity) done(direction FrameDirection) {
+	a.closed[direction].Store(true)
+}
+
+// checkActivity returns an error if the stream has been inactive for too long, or the time until it possibly will be.
+func (o *handlerOptions) checkActivity(a *streamActivity, now time.Time) (time.Duration, error) {
+	next := time.Duration(-1)
+	expires := func(last int64, timeout time.Duration) time.Duration {
+		left := time.Unix(0, last).Add(timeout).Sub(now)
+		if next < 0 || left < next {
+			next = left
+		}
+		return left
+	}
+	for direction, timeout := range o.stallTimeouts {
+		if timeout <= 0 || a.closed[direction].Load() {
+			continue
+		}
+		if expires(a.last[direction].Load(), timeout) <= 0 {
+			return 0, status.Errorf(codes.DeadlineExceeded, "proxy: stream stalled, no %s message for %v", direction, timeout)
+		}
+	}
+	if o.idleTimeout > 0 {
+		last := a.last[ClientToBackend].Load()
+		if l := a.last[BackendToClient].Load(); l > last {
+			last = l
+		}
+		if expires(last, o.idleTimeout) <= 0 {
+			return 0, status.Errorf(codes.DeadlineExceeded, "proxy: stream idle for %v", o.idleTimeout)
+		}
+	}
+	return next, nil
+}
+
+// watchActivity cancels the stream with an explanatory status when it becomes idle or stalls. It returns when ctx is
+// done, or when no further checks are needed.
+func (o *handlerOptions) watchActivity(ctx context.Context, a *streamActivity, cancel context.CancelCauseFunc) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			next, err := o.checkActivity(a, now)
+			if err != nil {
+				cancel(err)
+				return
+			}
+			if next < 0 {
+				return
+			}
+			timer.Reset(next)
+		}
+	}
+}
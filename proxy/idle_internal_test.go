@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckActivity_Idle(t *testing.T) {
+	o := evaluateOptions([]HandlerOption{WithIdleTimeout(time.Minute)})
+	a := newStreamActivity()
+	start := time.Now()
+
+	next, err := o.checkActivity(a, start.Add(30*time.Second))
+	require.NoError(t, err)
+	assert.InDelta(t, 30*time.Second, next, float64(time.Second))
+
+	a.last[BackendToClient].Store(start.Add(45 * time.Second).UnixNano())
+	next, err = o.checkActivity(a, start.Add(90*time.Second))
+	require.NoError(t, err, "activity in any direction keeps the stream alive")
+	assert.InDelta(t, 15*time.Second, next, float64(time.Second))
+
+	_, err = o.checkActivity(a, start.Add(2*time.Minute))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "idle")
+}
+
+func TestCheckActivity_Stall(t *testing.T) {
+	o := evaluateOptions([]HandlerOption{WithStallTimeout(BackendToClient, time.Minute)})
+	a := newStreamActivity()
+	start := time.Now()
+
+	a.last[ClientToBackend].Store(start.Add(59 * time.Second).UnixNano())
+	_, err := o.checkActivity(a, start.Add(61*time.Second))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "activity in the other direction does not count")
+	assert.Contains(t, status.Convert(err).Message(), "backend_to_client")
+
+	a.done(BackendToClient)
+	next, err := o.checkActivity(a, start.Add(61*time.Second))
+	require.NoError(t, err, "closed directions do not stall")
+	assert.Equal(t, time.Duration(-1), next, "no more checks needed")
+}
@@ -0,0 +1,31 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+func TestHandler_IdleStreamsAreCancelled(t *testing.T) {
+	client := proxyTestClient(t, nil, proxy.WithIdleTimeout(50*time.Millisecond))
+
+	stream, err := client.PingStream(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, stream.Send(&testservice.PingRequest{Value: "hello"}))
+		_, err := stream.Recv()
+		require.NoError(t, err, "active streams must not be cancelled")
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "idle")
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+// unknownLabel is the label value of methods outside the allowlist, and of calls not attributed to a backend or group.
+const unknownLabel = "unknown"
+
+// Metrics records Prometheus metrics about the calls handled by the proxy. It is a prometheus.Collector, to be
+// registered with a prometheus.Registerer, and learns about calls handled with WithMetrics.
+//
+// Calls are labelled with their method, backend and group, see StreamInfo. As a transparent proxy may see arbitrary
+// method names, only the methods of the allowlist set with WithMetricsMethods are labelled with their name, and all
+// others with "unknown". Messages and bytes are counted as they are forwarded.
+type Metrics struct {
+	methods          []string
+	started          *prometheus.CounterVec
+	handled          *prometheus.CounterVec
+	messages         *prometheus.CounterVec
+	bytes            *prometheus.CounterVec
+	duration         *prometheus.HistogramVec
+	firstResponse    *prometheus.HistogramVec
+	directorDuration *prometheus.HistogramVec
+	directorErrors   *prometheus.CounterVec
+}
+
+type metricsOptions struct {
+	namespace string
+	methods   []string
+	buckets   []float64
+}
+
+// MetricsOption configures Metrics.
+type MetricsOption func(*metricsOptions)
+
+// WithMetricsNamespace sets the namespace of the metrics, "grpc_proxy" by default.
+func WithMetricsNamespace(namespace string) MetricsOption {
+	return func(o *metricsOptions) {
+		o.namespace = namespace
+	}
+}
+
+// WithMetricsMethods adds patterns, with the same syntax as TimeoutRule.Method, to the allowlist of methods labelled
+// with their name. Patterns should only match a bounded number of methods.
+func WithMetricsMethods(patterns ...string) MetricsOption {
+	return func(o *metricsOptions) {
+		o.methods = append(o.methods, patterns...)
+	}
+}
+
+// WithMetricsBuckets sets the buckets, in seconds, of the duration histograms, prometheus.DefBuckets by default.
+func WithMetricsBuckets(buckets []float64) MetricsOption {
+	return func(o *metricsOptions) {
+		o.buckets = buckets
+	}
+}
+
+// NewMetrics creates Metrics.
+func NewMetrics(opts ...MetricsOption) *Metrics {
+	o := &metricsOptions{namespace: "grpc_proxy", buckets: prometheus.DefBuckets}
+	for _, opt := range opts {
+		opt(o)
+	}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: o.namespace, Name: name, Help: help}, labels)
+	}
+	histogram := func(name, help string, labels ...string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: o.namespace, Name: name, Help: help, Buckets: o.buckets}, labels)
+	}
+	return &Metrics{
+		methods:          o.methods,
+		started:          counter("streams_started_total", "Number of streams started by clients of the proxy.", "method"),
+		handled:          counter("streams_handled_total", "Number of streams completed by the proxy, by status code.", "method", "backend", "group", "code"),
+		messages:         counter("messages_total", "Number of messages forwarded by the proxy.", "method", "backend", "direction"),
+		bytes:            counter("message_bytes_total", "Size of the messages forwarded by the proxy, in bytes.", "method", "backend", "direction"),
+		duration:         histogram("stream_duration_seconds", "Duration of the streams handled by the proxy.", "method", "backend"),
+		firstResponse:    histogram("first_response_seconds", "Time from the start of streams to the first message of the backend.", "method", "backend"),
+		directorDuration: histogram("director_duration_seconds", "Time spent in the StreamDirector.", "method"),
+		directorErrors:   counter("director_errors_total", "Number of calls the StreamDirector failed, by status code.", "method", "code"),
+	}
+}
+
+// WithMetrics makes the handler record the calls it handles in m.
+func WithMetrics(m *Metrics) HandlerOption {
+	return func(o *handlerOptions) {
+		o.metrics = m
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.started, m.handled, m.messages, m.bytes, m.duration, m.firstResponse, m.directorDuration, m.directorErrors}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) methodLabel(fullMethodName string) string {
+	for _, pattern := range m.methods {
+		if matchMethod(pattern, fullMethodName) {
+			return fullMethodName
+		}
+	}
+	return unknownLabel
+}
+
+func labelOrUnknown(value string) string {
+	if value == "" {
+		return unknownLabel
+	}
+	return value
+}
+
+// observe records the start of the call described by info, and its outcome once it is done.
+func (m *Metrics) observe(info *StreamInfo) {
+	method := m.methodLabel(info.FullMethod)
+	m.started.WithLabelValues(method).Inc()
+	info.OnDone(func(err error) {
+		backend := labelOrUnknown(info.Backend())
+		m.handled.WithLabelValues(method, backend, labelOrUnknown(info.Group()), status.Code(err).String()).Inc()
+		m.duration.WithLabelValues(method, backend).Observe(time.Since(info.StartTime).Seconds())
+		if t := info.FirstResponse(); !t.IsZero() {
+			m.firstResponse.WithLabelValues(method, backend).Observe(t.Sub(info.StartTime).Seconds())
+		}
+	})
+}
+
+// messageCounter counts the messages forwarded in one direction of a call to one backend.
+type messageCounter struct {
+	messages prometheus.Counter
+	bytes    prometheus.Counter
+}
+
+// messageCounter returns the counter of the messages of the call described by info forwarded in direction d, to or
+// from its current backend. It returns nil if m is nil.
+func (m *Metrics) messageCounter(info *StreamInfo, d FrameDirection) *messageCounter {
+	if m == nil || info == nil {
+		return nil
+	}
+	method, backend := m.methodLabel(info.FullMethod), labelOrUnknown(info.Backend())
+	return &messageCounter{
+		messages: m.messages.WithLabelValues(method, backend, d.String()),
+		bytes:    m.bytes.WithLabelValues(method, backend, d.String()),
+	}
+}
+
+func (c *messageCounter) add(size int) {
+	if c == nil {
+		return
+	}
+	c.messages.Inc()
+	c.bytes.Add(float64(size))
+}
+
+// observeDirector records a call of the StreamDirector which took latency and returned err.
+func (m *Metrics) observeDirector(fullMethodName string, latency time.Duration, err error) {
+	method := m.methodLabel(fullMethodName)
+	m.directorDuration.WithLabelValues(method).Observe(latency.Seconds())
+	if err != nil {
+		m.directorErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+}
@@ -0,0 +1,106 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+func TestMetrics(t *testing.T) {
+	b, err := proxy.NewBalancer(proxy.RoundRobin, []string{"backend"})
+	require.NoError(t, err)
+	balancing := proxy.BalancingDirector(b, map[string]grpc.ClientConnInterface{"backend": testBackendConn(t, nil)})
+	director := func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		if fullMethodName == "/mwitkow.testproto.TestService/PingEmpty" {
+			return nil, nil, status.Error(codes.Unavailable, "no backend")
+		}
+		return balancing(ctx, fullMethodName)
+	}
+	metrics := proxy.NewMetrics(proxy.WithMetricsMethods("/mwitkow.testproto.TestService/Ping"))
+	client := directedTestClient(t, director, proxy.WithMetrics(metrics))
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+		require.NoError(t, err)
+	}
+	stream, err := client.PingList(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.Equal(t, io.EOF, err)
+	_, err = client.PingEmpty(context.Background(), &emptypb.Empty{})
+	require.Error(t, err)
+
+	expected := `
+# HELP grpc_proxy_streams_handled_total Number of streams completed by the proxy, by status code.
+# TYPE grpc_proxy_streams_handled_total counter
+grpc_proxy_streams_handled_total{backend="backend",code="OK",group="unknown",method="/mwitkow.testproto.TestService/Ping"} 2
+grpc_proxy_streams_handled_total{backend="backend",code="OK",group="unknown",method="unknown"} 1
+grpc_proxy_streams_handled_total{backend="unknown",code="Unavailable",group="unknown",method="unknown"} 1
+# HELP grpc_proxy_messages_total Number of messages forwarded by the proxy.
+# TYPE grpc_proxy_messages_total counter
+grpc_proxy_messages_total{backend="backend",direction="backend_to_client",method="/mwitkow.testproto.TestService/Ping"} 2
+grpc_proxy_messages_total{backend="backend",direction="backend_to_client",method="unknown"} 10
+grpc_proxy_messages_total{backend="backend",direction="client_to_backend",method="/mwitkow.testproto.TestService/Ping"} 2
+grpc_proxy_messages_total{backend="backend",direction="client_to_backend",method="unknown"} 1
+# HELP grpc_proxy_director_errors_total Number of calls the StreamDirector failed, by status code.
+# TYPE grpc_proxy_director_errors_total counter
+grpc_proxy_director_errors_total{code="Unavailable",method="unknown"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(expected),
+		"grpc_proxy_streams_handled_total", "grpc_proxy_messages_total", "grpc_proxy_director_errors_total"))
+	// "hello" requests and responses are 7 bytes long, and PingList sends 10 of them with counters.
+	assert.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP grpc_proxy_message_bytes_total Size of the messages forwarded by the proxy, in bytes.
+# TYPE grpc_proxy_message_bytes_total counter
+grpc_proxy_message_bytes_total{backend="backend",direction="backend_to_client",method="/mwitkow.testproto.TestService/Ping"} 14
+grpc_proxy_message_bytes_total{backend="backend",direction="backend_to_client",method="unknown"} 88
+grpc_proxy_message_bytes_total{backend="backend",direction="client_to_backend",method="/mwitkow.testproto.TestService/Ping"} 14
+grpc_proxy_message_bytes_total{backend="backend",direction="client_to_backend",method="unknown"} 7
+`), "grpc_proxy_message_bytes_total"))
+
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics, "grpc_proxy_streams_started_total"))
+	assert.Equal(t, 3, testutil.CollectAndCount(metrics, "grpc_proxy_stream_duration_seconds"))
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics, "grpc_proxy_first_response_seconds"))
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics, "grpc_proxy_director_duration_seconds"))
+	problems, err := testutil.CollectAndLint(metrics)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestMetrics_CountsMessagesOfOpenStreams(t *testing.T) {
+	metrics := proxy.NewMetrics()
+	client := balancedTestClient(t, nil, proxy.WithMetrics(metrics))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.PingStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "hello"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// The response is counted after it was sent to the client, so it may not be counted yet.
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP grpc_proxy_messages_total Number of messages forwarded by the proxy.
+# TYPE grpc_proxy_messages_total counter
+grpc_proxy_messages_total{backend="backend",direction="backend_to_client",method="unknown"} 1
+grpc_proxy_messages_total{backend="backend",direction="client_to_backend",method="unknown"} 1
+`), "grpc_proxy_messages_total") == nil
+	}, time.Second, time.Millisecond, "messages must be counted before the stream ends")
+}
@@ -0,0 +1,319 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Mirror sends a copy of proxied calls to a shadow backend, to try it out on real traffic without affecting the
+// clients. The messages of the client are copied to the shadow backend as they are received, and the responses of the
+// shadow backend are discarded, or handed to a comparison function along with the ones of the primary backend.
+//
+// Mirroring never blocks or fails the primary call: when the shadow backend falls behind by more messages than the
+// queue size, the mirrored call is dropped. Mirrored calls outlive the primary ones, up to a timeout.
+type Mirror struct {
+	cc           grpc.ClientConnInterface
+	rules        []mirrorRule
+	queueSize    int
+	timeout      time.Duration
+	compare      func(*MirrorResult)
+	compareLimit int
+}
+
+type mirrorRule struct {
+	method  string
+	percent float64
+}
+
+// MirrorResult holds the outcome of a call forwarded to both the primary and the shadow backend.
+type MirrorResult struct {
+	FullMethod string
+	// Primary and Shadow are the raw messages sent by the backends.
+	Primary, Shadow       [][]byte
+	PrimaryErr, ShadowErr error
+	// Truncated reports that the backends sent more bytes than recorded for the comparison, so that Primary and
+	// Shadow are incomplete.
+	Truncated bool
+}
+
+// Equal reports whether both backends ended the call with the same status code and sent the same messages.
+//
+// Messages are compared by their encoding, which is not canonical: equal messages with map fields may be reported as
+// different.
+func (r *MirrorResult) Equal() bool {
+	if status.Code(r.PrimaryErr) != status.Code(r.ShadowErr) || len(r.Primary) != len(r.Shadow) {
+		return false
+	}
+	for i := range r.Primary {
+		if !bytes.Equal(r.Primary[i], r.Shadow[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MirrorOption configures a Mirror.
+type MirrorOption func(*Mirror)
+
+// WithMirrorSampling mirrors the given percentage, between 0 and 100, of the calls to the methods matching method,
+// with the same syntax as TimeoutRule.Method. Rules are evaluated in order and only the first rule matching a method
+// applies. Methods matching no rule are not mirrored. Without rules, all calls are mirrored.
+func WithMirrorSampling(method string, percent float64) MirrorOption {
+	return func(m *Mirror) {
+		m.rules = append(m.rules, mirrorRule{method: method, percent: percent})
+	}
+}
+
+// WithMirrorQueueSize sets the number of messages of the client queued for the shadow backend, 64 by default.
+func WithMirrorQueueSize(n int) MirrorOption {
+	return func(m *Mirror) {
+		m.queueSize = n
+	}
+}
+
+// WithMirrorTimeout sets the time mirrored calls are given to complete, 10 seconds by default.
+func WithMirrorTimeout(d time.Duration) MirrorOption {
+	return func(m *Mirror) {
+		m.timeout = d
+	}
+}
+
+// WithMirrorComparison calls f with the outcome of every mirrored call, once both backends are done with it. At most
+// limit bytes of messages are recorded per backend. The function is called from its own goroutine.
+func WithMirrorComparison(f func(*MirrorResult), limit int) MirrorOption {
+	return func(m *Mirror) {
+		m.compare = f
+		m.compareLimit = limit
+	}
+}
+
+// NewMirror creates a Mirror sending calls to the shadow backend reachable through cc.
+func NewMirror(cc grpc.ClientConnInterface, opts ...MirrorOption) *Mirror {
+	m := &Mirror{
+		cc:        cc,
+		queueSize: 64,
+		timeout:   10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// WithMirror makes the handler mirror calls with m. Shadow streams are opened with the interceptors and call options
+// of the handler, and carry the metadata of the client.
+func WithMirror(m *Mirror) HandlerOption {
+	return func(o *handlerOptions) {
+		o.mirror = m
+	}
+}
+
+func (m *Mirror) sampled(fullMethodName string) bool {
+	if len(m.rules) == 0 {
+		return true
+	}
+	for _, r := range m.rules {
+		if matchMethod(r.method, fullMethodName) {
+			return rand.Float64()*100 < r.percent
+		}
+	}
+	return false
+}
+
+// tee starts mirroring the call on serverStream if it is sampled, and returns the stream the call is to be proxied
+// with.
+func (m *Mirror) tee(ctx context.Context, serverStream grpc.ServerStream, fullMethodName string, opts *handlerOptions) grpc.ServerStream {
+	if !m.sampled(fullMethodName) {
+		return serverStream
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	shadowCtx := withRequestID(ctx, metadata.NewOutgoingContext(context.WithoutCancel(ctx), md.Copy()))
+	shadowCtx, cancel := context.WithTimeout(shadowCtx, m.timeout)
+	c := &mirrorCall{
+		m:      m,
+		frames: make(chan []byte, m.queueSize),
+		done:   make(chan struct{}),
+		result: MirrorResult{FullMethod: fullMethodName},
+	}
+	c.ctx, c.cancel = context.WithCancelCause(shadowCtx)
+	go func() {
+		defer cancel()
+		c.run(opts, fullMethodName)
+	}()
+	if info, ok := StreamInfoFromContext(ctx); ok {
+		info.OnDone(c.primaryDone)
+	}
+	return &mirroredStream{ServerStream: serverStream, call: c}
+}
+
+// mirrorCall is a call mirrored to the shadow backend.
+type mirrorCall struct {
+	m      *Mirror
+	frames chan []byte
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	dropped bool
+	result  MirrorResult
+	sizes   [2]int
+}
+
+// send queues a message of the client for the shadow backend, dropping the mirrored call if the queue is full.
+func (c *mirrorCall) send(payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.dropped {
+		return
+	}
+	select {
+	case c.frames <- payload:
+	default:
+		c.dropped = true
+		c.cancel(status.Error(codes.ResourceExhausted, "proxy: mirrored call dropped, the shadow backend fell behind"))
+	}
+}
+
+// closeSend ends the messages of the client.
+func (c *mirrorCall) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.frames)
+	}
+}
+
+// record records a message of the primary (0) or shadow (1) backend for the comparison.
+func (c *mirrorCall) record(backend int, payload []byte) {
+	if c.m.compare == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes[backend] += len(payload); c.sizes[backend] > c.m.compareLimit {
+		c.result.Truncated = true
+		return
+	}
+	msg := append([]byte(nil), payload...)
+	if backend == 0 {
+		c.result.Primary = append(c.result.Primary, msg)
+	} else {
+		c.result.Shadow = append(c.result.Shadow, msg)
+	}
+}
+
+// primaryDone records the outcome of the primary call. A mirrored call whose client did not finish sending is dropped.
+func (c *mirrorCall) primaryDone(err error) {
+	c.mu.Lock()
+	c.result.PrimaryErr = err
+	closed := c.closed
+	c.mu.Unlock()
+	if !closed {
+		c.cancel(status.Error(codes.Canceled, "proxy: mirrored call dropped, the primary call ended early"))
+	}
+	if c.m.compare != nil {
+		go func() {
+			<-c.done
+			c.m.compare(&c.result)
+		}()
+	}
+}
+
+// run forwards the mirrored call to the shadow backend.
+func (c *mirrorCall) run(opts *handlerOptions, fullMethodName string) {
+	defer close(c.done)
+	stream, err := opts.newClientStream(c.ctx, c.m.cc, fullMethodName)
+	if err != nil {
+		c.finish(err)
+		return
+	}
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case payload, ok := <-c.frames:
+				if !ok {
+					stream.CloseSend()
+					return
+				}
+				f := &emptypb.Empty{}
+				f.ProtoReflect().SetUnknown(payload)
+				if stream.SendMsg(f) != nil {
+					return
+				}
+			}
+		}
+	}()
+	for {
+		f := &emptypb.Empty{}
+		if err = stream.RecvMsg(f); err != nil {
+			break
+		}
+		c.record(1, f.ProtoReflect().GetUnknown())
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	c.cancel(nil)
+	<-sendDone
+	c.finish(err)
+}
+
+func (c *mirrorCall) finish(err error) {
+	if cause := context.Cause(c.ctx); err != nil && cause != nil {
+		if _, ok := status.FromError(cause); ok {
+			err = cause
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.result.ShadowErr = err
+}
+
+// mirroredStream is the grpc.ServerStream a mirrored call is proxied with. It copies the messages of the client to
+// the shadow backend, and records the ones sent to the client for the comparison.
+type mirroredStream struct {
+	grpc.ServerStream
+	call *mirrorCall
+}
+
+func (s *mirroredStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.call.closeSend()
+	case err != nil:
+		s.call.cancel(status.Error(codes.Canceled, "proxy: mirrored call dropped, the client failed"))
+	default:
+		s.call.send(append([]byte(nil), m.(proto.Message).ProtoReflect().GetUnknown()...))
+	}
+	return err
+}
+
+func (s *mirroredStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.call.record(0, m.(proto.Message).ProtoReflect().GetUnknown())
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// mirrorTo returns the option mirroring calls to shadow, or to the default test service if nil, with opts. The
+// results of the comparisons are sent on the returned channel.
+func mirrorTo(t *testing.T, shadow testservice.TestServiceServer, opts ...proxy.MirrorOption) (proxy.HandlerOption, chan *proxy.MirrorResult) {
+	t.Helper()
+	results := make(chan *proxy.MirrorResult, 10)
+	opts = append(opts, proxy.WithMirrorComparison(func(r *proxy.MirrorResult) { results <- r }, 1<<10))
+	return proxy.WithMirror(proxy.NewMirror(testBackendConn(t, shadow), opts...)), results
+}
+
+func receiveResult(t *testing.T, results chan *proxy.MirrorResult) *proxy.MirrorResult {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mirrored call completed")
+		return nil
+	}
+}
+
+func TestMirror_ComparesResponses(t *testing.T) {
+	mirror, results := mirrorTo(t, nil)
+	client := proxyTestClient(t, nil, mirror)
+
+	resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	r := receiveResult(t, results)
+	assert.Equal(t, "/mwitkow.testproto.TestService/Ping", r.FullMethod)
+	assert.Len(t, r.Shadow, 1)
+	assert.True(t, r.Equal())
+
+	stream, err := client.PingList(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	r = receiveResult(t, results)
+	assert.NotEmpty(t, r.Primary)
+	assert.True(t, r.Equal())
+}
+
+func TestMirror_ShadowFailureDoesNotAffectPrimary(t *testing.T) {
+	failing := &failingService{err: status.Error(codes.Internal, "broken")}
+	mirror, results := mirrorTo(t, failing)
+	client := proxyTestClient(t, nil, mirror)
+
+	resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	r := receiveResult(t, results)
+	assert.NoError(t, r.PrimaryErr)
+	assert.Equal(t, codes.Internal, status.Code(r.ShadowErr))
+	assert.False(t, r.Equal())
+}
+
+func TestMirror_HangingShadowDoesNotBlockPrimary(t *testing.T) {
+	hanging := &hangingService{cancelled: make(chan struct{})}
+	mirror, results := mirrorTo(t, hanging, proxy.WithMirrorTimeout(50*time.Millisecond))
+	client := proxyTestClient(t, nil, mirror)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	r := receiveResult(t, results)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(r.ShadowErr))
+}
+
+func TestMirror_Sampling(t *testing.T) {
+	mirror, results := mirrorTo(t, nil,
+		proxy.WithMirrorSampling("/mwitkow.testproto.TestService/Ping", 0),
+		proxy.WithMirrorSampling("/mwitkow.testproto.TestService/PingEmpty", 100))
+	client := proxyTestClient(t, nil, mirror)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+		require.NoError(t, err)
+	}
+	_, err := client.PingEmpty(context.Background(), &emptypb.Empty{})
+	require.NoError(t, err)
+	_, err = client.PingError(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.Error(t, err)
+
+	r := receiveResult(t, results)
+	assert.Equal(t, "/mwitkow.testproto.TestService/PingEmpty", r.FullMethod)
+	select {
+	case r := <-results:
+		t.Fatalf("unexpected mirrored call to %s", r.FullMethod)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HandlerOption configures the proxying handler created by TransparentHandler and RegisterServiceWithOptions.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	forwarded          *ForwardedHeaders
+	streamInterceptors []grpc.StreamClientInterceptor
+	callOptions        []grpc.CallOption
+	frameInterceptors  []FrameInterceptor
+	errorMapper        ErrorMapper
+	timeouts           []TimeoutRule
+	idleTimeout        time.Duration
+	stallTimeouts      map[FrameDirection]time.Duration
+	outliers           *OutlierDetector
+	breakers           *CircuitBreakers
+	retries            []RetryPolicy
+	retryBudget        *retryBudget
+	hedging            []HedgingPolicy
+	mirror             *Mirror
+	metrics            *Metrics
+	tracing            *Tracing
+	accessLog          *AccessLog
+	requestIDs         *RequestIDs
+	capture            *Capture
+}
+
+func evaluateOptions(opts []HandlerOption) *handlerOptions {
+	o := &handlerOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithForwardedHeaders makes the handler append forwarding metadata describing the inbound peer to every call it
+// forwards, after the StreamDirector returned its outgoing context. Metadata the director forwards from the inbound
+// call is therefore subject to the trust rules of fwd.
+func WithForwardedHeaders(fwd ForwardedHeaders) HandlerOption {
+	return func(o *handlerOptions) {
+		o.forwarded = &fwd
+	}
+}
+
+// WithStreamClientInterceptors adds interceptors that wrap the creation of the stream to the backend.
+//
+// The interceptors see the outgoing context returned by the StreamDirector and may decorate or replace the
+// grpc.ClientStream used for forwarding. They are executed in the order given, the first one being the outermost.
+// As they are given the *grpc.ClientConn of the backend, calls fail with codes.Internal if the StreamDirector returns
+// any other grpc.ClientConnInterface.
+func WithStreamClientInterceptors(interceptors ...grpc.StreamClientInterceptor) HandlerOption {
+	return func(o *handlerOptions) {
+		o.streamInterceptors = append(o.streamInterceptors, interceptors...)
+	}
+}
+
+// WithCallOptions sets grpc.CallOptions used when opening the stream to the backend, e.g. grpc.MaxCallRecvMsgSize
+// to allow forwarding of messages larger than the default limits.
+func WithCallOptions(opts ...grpc.CallOption) HandlerOption {
+	return func(o *handlerOptions) {
+		o.callOptions = append(o.callOptions, opts...)
+	}
+}
+
+// newClientStream opens the stream to the backend, passing it through the configured interceptors.
+func (o *handlerOptions) newClientStream(ctx context.Context, cc grpc.ClientConnInterface, method string) (grpc.ClientStream, error) {
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, _ *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return cc.NewStream(ctx, desc, method, opts...)
+	}
+	// Interceptors expect a concrete *grpc.ClientConn, which may not be what the director returned.
+	conn, ok := cc.(*grpc.ClientConn)
+	if !ok && len(o.streamInterceptors) > 0 {
+		return nil, status.Errorf(codes.Internal, "proxy: stream client interceptors need a *grpc.ClientConn, the director returned a %T", cc)
+	}
+	for i := len(o.streamInterceptors) - 1; i >= 0; i-- {
+		interceptor, next := o.streamInterceptors[i], streamer
+		streamer = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return interceptor(ctx, desc, cc, method, next, opts...)
+		}
+	}
+	return streamer(ctx, clientStreamDescForProxying, conn, method, o.callOptions...)
+}
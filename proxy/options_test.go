@@ -0,0 +1,91 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+func TestHandlerOptions(t *testing.T) {
+	backendCC, err := backendDialer(t)
+	require.NoError(t, err)
+
+	var intercepted []string
+	interceptor := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		intercepted = append(intercepted, method)
+		ctx = metadata.AppendToOutgoingContext(ctx, "intercepted-by", "test")
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	proxySrv := grpc.NewServer(proxy.DefaultProxyOpt(backendCC,
+		proxy.WithForwardedHeaders(proxy.ForwardedHeaders{}),
+		proxy.WithStreamClientInterceptors(interceptor),
+		proxy.WithCallOptions(grpc.MaxCallRecvMsgSize(1<<20)),
+	))
+	proxyCC, err := proxyDialer(t, proxySrv)
+	require.NoError(t, err)
+	client := testservice.NewTestServiceClient(proxyCC)
+
+	// The test backend echoes all inbound metadata in its response headers.
+	hdr := metadata.MD{}
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&hdr))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/mwitkow.testproto.TestService/Ping"}, intercepted)
+	assert.Equal(t, []string{"test"}, hdr.Get("intercepted-by"))
+	assert.Equal(t, []string{"unknown"}, hdr.Get(proxy.XForwardedForKey), "bufconn peers have no IP address")
+	assert.Equal(t, []string{"bufnet"}, hdr.Get(proxy.XForwardedHostKey))
+
+	testservice.TestTestServiceServerImpl(t, client)
+}
+
+// wrappedConn is a grpc.ClientConnInterface other than a *grpc.ClientConn.
+type wrappedConn struct {
+	grpc.ClientConnInterface
+}
+
+func TestHandlerOptions_InterceptorsNeedClientConn(t *testing.T) {
+	backendCC, err := backendDialer(t)
+	require.NoError(t, err)
+
+	intercepted := false
+	interceptor := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		intercepted = true
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	director := func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		return ctx, wrappedConn{backendCC}, nil
+	}
+	client := directedTestClient(t, director, proxy.WithStreamClientInterceptors(interceptor))
+
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "proxy_test.wrappedConn")
+	assert.False(t, intercepted, "interceptors must not be given a nil *grpc.ClientConn")
+}
+
+func TestRegisterServiceWithOptions(t *testing.T) {
+	backendCC, err := backendDialer(t)
+	require.NoError(t, err)
+
+	proxySrv := grpc.NewServer()
+	proxy.RegisterServiceWithOptions(proxySrv, proxy.DefaultDirector(backendCC),
+		"mwitkow.testproto.TestService", []string{"Ping"},
+		proxy.WithForwardedHeaders(proxy.ForwardedHeaders{}))
+	proxyCC, err := proxyDialer(t, proxySrv)
+	require.NoError(t, err)
+	client := testservice.NewTestServiceClient(proxyCC)
+
+	hdr := metadata.MD{}
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&hdr))
+	require.NoError(t, err)
+	assert.NotEmpty(t, hdr.Get(proxy.ForwardedKey))
+}
@@ -0,0 +1,263 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierDetector passively watches the outcome of proxied calls per backend and temporarily ejects backends that
+// misbehave, complementing active health checks with what real traffic shows.
+//
+// A backend is ejected when it fails too many calls in a row, when its failure rate over an interval is too high, or
+// when its mean latency over an interval is far above the one of the other backends. Each ejection of the same
+// backend lasts twice as long as the previous one, and the multiplier decreases again for every interval the backend
+// spends without being ejected.
+//
+// The detector learns from calls handled with WithOutlierDetection. Its Healthy method can be given to
+// WithBalancerHealth, WithRouterHealth or WithStickyHealth, so that directors skip ejected backends.
+type OutlierDetector struct {
+	consecutiveFailures int
+	failureRate         float64
+	failureRateMinCalls int
+	latencyFactor       float64
+	latencyMinCalls     int
+	interval            time.Duration
+	baseEjection        time.Duration
+	maxEjection         time.Duration
+	maxEjectionPercent  int
+	failureCodes        map[codes.Code]bool
+	now                 func() time.Time
+
+	mu       sync.Mutex
+	backends map[string]*outlierStats
+	nextEval time.Time
+}
+
+type outlierStats struct {
+	consecutive int
+	// calls, failures and latency are counted over the current interval.
+	calls        int
+	failures     int
+	latency      time.Duration
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// OutlierOption configures an OutlierDetector.
+type OutlierOption func(*OutlierDetector)
+
+// WithOutlierConsecutiveFailures sets the number of failed calls in a row that eject a backend, 5 by default. Zero
+// disables this detection.
+func WithOutlierConsecutiveFailures(n int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.consecutiveFailures = n
+	}
+}
+
+// WithOutlierFailureRate ejects backends whose share of failed calls over an interval reaches rate, between 0 and 1,
+// provided they handled at least minCalls calls in the interval. It is disabled by default.
+func WithOutlierFailureRate(rate float64, minCalls int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.failureRate = rate
+		d.failureRateMinCalls = minCalls
+	}
+}
+
+// WithOutlierLatency ejects backends whose mean call duration over an interval exceeds factor times the median of
+// the mean durations of all backends. Only backends with at least minCalls calls in the interval are compared, and at
+// least three of them are needed. It is disabled by default.
+//
+// Durations are measured for whole calls, so this is meant for backends mostly serving unary calls.
+func WithOutlierLatency(factor float64, minCalls int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.latencyFactor = factor
+		d.latencyMinCalls = minCalls
+	}
+}
+
+// WithOutlierInterval sets the interval over which failure rates and latencies are evaluated, 10 seconds by default.
+func WithOutlierInterval(interval time.Duration) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.interval = interval
+	}
+}
+
+// WithOutlierEjectionTime sets the duration of the first ejection of a backend, 30 seconds by default, and the
+// maximum duration of later ones, 5 minutes by default.
+func WithOutlierEjectionTime(base, max time.Duration) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.baseEjection = base
+		d.maxEjection = max
+	}
+}
+
+// WithOutlierMaxEjectionPercent caps the share of known backends that can be ejected at the same time, 10 percent by
+// default. One backend can always be ejected, unless the percentage is zero.
+func WithOutlierMaxEjectionPercent(percent int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.maxEjectionPercent = percent
+	}
+}
+
+// WithOutlierFailureCodes sets the status codes counted as failures, by default Unavailable and Internal.
+func WithOutlierFailureCodes(failureCodes ...codes.Code) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.failureCodes = make(map[codes.Code]bool)
+		for _, c := range failureCodes {
+			d.failureCodes[c] = true
+		}
+	}
+}
+
+// NewOutlierDetector creates an OutlierDetector that knows no backends yet.
+func NewOutlierDetector(opts ...OutlierOption) *OutlierDetector {
+	d := &OutlierDetector{
+		consecutiveFailures: 5,
+		interval:            10 * time.Second,
+		baseEjection:        30 * time.Second,
+		maxEjection:         5 * time.Minute,
+		maxEjectionPercent:  10,
+		failureCodes:        map[codes.Code]bool{codes.Unavailable: true, codes.Internal: true},
+		now:                 time.Now,
+		backends:            make(map[string]*outlierStats),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// WithOutlierDetection makes the handler report the outcome of every attempt attributed to a backend, see
+// StreamInfo.SetBackend, to d. Attempts the proxy or the client ended, such as cancelled ones or ones hitting a
+// deadline set by WithTimeouts, are not reported.
+func WithOutlierDetection(d *OutlierDetector) HandlerOption {
+	return func(o *handlerOptions) {
+		o.outliers = d
+	}
+}
+
+// Record records the outcome of a call forwarded to backend, which took latency and ended with err. Calls handled
+// with WithOutlierDetection are recorded automatically.
+func (d *OutlierDetector) Record(backend string, latency time.Duration, err error) {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evaluateLocked(now)
+	st, ok := d.backends[backend]
+	if !ok {
+		st = &outlierStats{}
+		d.backends[backend] = st
+	}
+	st.calls++
+	st.latency += latency
+	if err == nil || !d.failureCodes[status.Code(err)] {
+		st.consecutive = 0
+		return
+	}
+	st.failures++
+	st.consecutive++
+	if d.consecutiveFailures > 0 && st.consecutive >= d.consecutiveFailures {
+		st.consecutive = 0
+		d.ejectLocked(st, now)
+	}
+}
+
+// Healthy reports whether a backend is not ejected. Backends the detector knows nothing about are healthy.
+func (d *OutlierDetector) Healthy(backend string) bool {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st, ok := d.backends[backend]
+	return !ok || !now.Before(st.ejectedUntil)
+}
+
+// EjectedBackends returns the names of the currently ejected backends, in order.
+func (d *OutlierDetector) EjectedBackends() []string {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ejected []string
+	for backend, st := range d.backends {
+		if now.Before(st.ejectedUntil) {
+			ejected = append(ejected, backend)
+		}
+	}
+	sort.Strings(ejected)
+	return ejected
+}
+
+// evaluateLocked ejects backends by failure rate and latency once an interval has passed, and starts a new one.
+func (d *OutlierDetector) evaluateLocked(now time.Time) {
+	if now.Before(d.nextEval) {
+		return
+	}
+	d.nextEval = now.Add(d.interval)
+
+	if d.failureRate > 0 {
+		for _, st := range d.backends {
+			if st.calls > 0 && st.calls >= d.failureRateMinCalls && float64(st.failures)/float64(st.calls) >= d.failureRate {
+				d.ejectLocked(st, now)
+			}
+		}
+	}
+	if d.latencyFactor > 0 {
+		var means []time.Duration
+		for _, st := range d.backends {
+			if st.calls > 0 && st.calls >= d.latencyMinCalls {
+				means = append(means, st.latency/time.Duration(st.calls))
+			}
+		}
+		if len(means) >= 3 {
+			sort.Slice(means, func(i, j int) bool { return means[i] < means[j] })
+			limit := time.Duration(float64(means[len(means)/2]) * d.latencyFactor)
+			for _, st := range d.backends {
+				if st.calls > 0 && st.calls >= d.latencyMinCalls && st.latency/time.Duration(st.calls) > limit {
+					d.ejectLocked(st, now)
+				}
+			}
+		}
+	}
+
+	for _, st := range d.backends {
+		if st.ejections > 0 && !now.Before(st.ejectedUntil) {
+			st.ejections--
+		}
+		st.calls, st.failures, st.latency = 0, 0, 0
+	}
+}
+
+// ejectLocked ejects the backend of st, unless it is already ejected or too many backends are.
+func (d *OutlierDetector) ejectLocked(st *outlierStats, now time.Time) {
+	if now.Before(st.ejectedUntil) {
+		return
+	}
+	ejected := 0
+	for _, other := range d.backends {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	allowed := len(d.backends) * d.maxEjectionPercent / 100
+	if allowed < 1 && d.maxEjectionPercent > 0 {
+		allowed = 1
+	}
+	if ejected >= allowed {
+		return
+	}
+	st.ejections++
+	duration := d.baseEjection
+	for i := 1; i < st.ejections && duration < d.maxEjection; i++ {
+		duration *= 2
+	}
+	if duration > d.maxEjection {
+		duration = d.maxEjection
+	}
+	st.ejectedUntil = now.Add(duration)
+}
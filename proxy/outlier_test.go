@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestOutlierDetector(opts ...OutlierOption) (*OutlierDetector, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	d := NewOutlierDetector(append([]OutlierOption{WithOutlierMaxEjectionPercent(100)}, opts...)...)
+	d.now = clock.now
+	return d, clock
+}
+
+var errUnavailable = status.Error(codes.Unavailable, "backend down")
+
+func TestOutlierDetector_ConsecutiveFailures(t *testing.T) {
+	d, clock := newTestOutlierDetector(
+		WithOutlierConsecutiveFailures(3),
+		WithOutlierEjectionTime(10*time.Second, 25*time.Second),
+		WithOutlierInterval(time.Hour),
+	)
+	d.Record("a", time.Millisecond, errUnavailable)
+	d.Record("a", time.Millisecond, errUnavailable)
+	d.Record("a", time.Millisecond, nil)
+	d.Record("a", time.Millisecond, errUnavailable)
+	d.Record("a", time.Millisecond, status.Error(codes.NotFound, "not a backend failure"))
+	assert.True(t, d.Healthy("a"), "successes and other codes reset the count")
+
+	ejectAndMeasure := func() time.Duration {
+		for i := 0; i < 3; i++ {
+			d.Record("a", time.Millisecond, errUnavailable)
+		}
+		require.False(t, d.Healthy("a"))
+		assert.Equal(t, []string{"a"}, d.EjectedBackends())
+		start := clock.t
+		for !d.Healthy("a") {
+			clock.advance(time.Second)
+		}
+		return clock.t.Sub(start)
+	}
+	assert.Equal(t, 10*time.Second, ejectAndMeasure())
+	assert.Equal(t, 20*time.Second, ejectAndMeasure(), "ejections must grow exponentially")
+	assert.Equal(t, 25*time.Second, ejectAndMeasure(), "ejections must be capped")
+	assert.True(t, d.Healthy("unknown"))
+}
+
+func TestOutlierDetector_FailureRate(t *testing.T) {
+	d, clock := newTestOutlierDetector(
+		WithOutlierConsecutiveFailures(0),
+		WithOutlierFailureRate(0.5, 10),
+		WithOutlierInterval(time.Second),
+	)
+	for i := 0; i < 20; i++ {
+		var err error
+		if i%2 == 0 {
+			err = status.Error(codes.Internal, "oops")
+		}
+		d.Record("a", time.Millisecond, err)
+		d.Record("b", time.Millisecond, nil)
+		if i < 5 {
+			d.Record("c", time.Millisecond, errUnavailable)
+		}
+	}
+	assert.True(t, d.Healthy("a"), "rates are evaluated once the interval ends")
+	clock.advance(time.Second)
+	d.Record("b", time.Millisecond, nil)
+	assert.Equal(t, []string{"a"}, d.EjectedBackends(), "c had too few calls to be judged")
+}
+
+func TestOutlierDetector_Latency(t *testing.T) {
+	d, clock := newTestOutlierDetector(
+		WithOutlierConsecutiveFailures(0),
+		WithOutlierLatency(3, 5),
+		WithOutlierInterval(time.Second),
+	)
+	latencies := map[string]time.Duration{"a": 10 * time.Millisecond, "b": 12 * time.Millisecond, "c": 11 * time.Millisecond, "d": 100 * time.Millisecond}
+	for i := 0; i < 5; i++ {
+		for backend, latency := range latencies {
+			d.Record(backend, latency, nil)
+		}
+	}
+	clock.advance(time.Second)
+	d.Record("a", time.Millisecond, nil)
+	assert.Equal(t, []string{"d"}, d.EjectedBackends())
+}
+
+func TestOutlierDetector_MaxEjectionPercent(t *testing.T) {
+	d, _ := newTestOutlierDetector(WithOutlierConsecutiveFailures(1), WithOutlierMaxEjectionPercent(30))
+	for i := 0; i < 10; i++ {
+		d.Record(fmt.Sprintf("backend-%d", i), time.Millisecond, nil)
+	}
+	for i := 0; i < 10; i++ {
+		d.Record(fmt.Sprintf("backend-%d", i), time.Millisecond, errUnavailable)
+	}
+	assert.Len(t, d.EjectedBackends(), 3)
+}
+
+func TestOutlierDetector_RecordsAttempts(t *testing.T) {
+	d, _ := newTestOutlierDetector(WithOutlierConsecutiveFailures(2),
+		WithOutlierFailureCodes(codes.Unavailable, codes.Internal, codes.DeadlineExceeded, codes.Canceled))
+	attempt := func(ctx context.Context) *backendStream {
+		b := &backendStream{record: func(err error) { d.Record("a", time.Millisecond, err) }}
+		b.ctx, b.cancel = context.WithCancelCause(ctx)
+		return b
+	}
+
+	attempt(context.Background()).finish(errUnavailable)
+	assert.Empty(t, d.EjectedBackends())
+
+	// Attempts ended by the proxy or the client say nothing about the backend.
+	attempt(context.Background()).finish(&frameAbortError{status.Error(codes.Internal, "frame dropped")})
+	attempt(context.Background()).finish(context.Canceled)
+	watched := attempt(context.Background())
+	idle := status.Error(codes.DeadlineExceeded, "proxy: stream idle")
+	watched.cancel(idle)
+	watched.finish(watched.explain(status.Error(codes.Canceled, "context canceled")))
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	attempt(ctx).finish(status.Error(codes.DeadlineExceeded, "context deadline exceeded"))
+	assert.Empty(t, d.EjectedBackends())
+
+	attempt(context.Background()).finish(errUnavailable)
+	assert.Equal(t, []string{"a"}, d.EjectedBackends())
+}
@@ -0,0 +1,284 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// BackendPool lazily dials and caches connections to backends, so that all calls proxied to the same target share a
+// single grpc.ClientConn instead of dialing one per call.
+//
+// Connections are reference counted. Ones that have not been used for the idle timeout, or that have failed and are
+// not in use, are closed by the pool and dialed again on the next use.
+type BackendPool struct {
+	dialOpts    []grpc.DialOption
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[poolKey]*pooledConn
+	closed bool
+	stop   chan struct{}
+}
+
+type poolKey struct {
+	target string
+	opts   string
+}
+
+type pooledConn struct {
+	cc       *grpc.ClientConn
+	refs     int
+	lastUsed time.Time
+}
+
+// PoolOption configures a BackendPool.
+type PoolOption func(*BackendPool)
+
+// WithPoolDialOptions sets the grpc.DialOptions used for all connections of the pool.
+func WithPoolDialOptions(opts ...grpc.DialOption) PoolOption {
+	return func(p *BackendPool) {
+		p.dialOpts = append(p.dialOpts, opts...)
+	}
+}
+
+// WithPoolIdleTimeout makes the pool close connections that have not been used by any call for d. By default
+// connections are kept until the pool is closed.
+func WithPoolIdleTimeout(d time.Duration) PoolOption {
+	return func(p *BackendPool) {
+		p.idleTimeout = d
+	}
+}
+
+// NewBackendPool creates an empty BackendPool. It must be closed with Close when no longer needed.
+func NewBackendPool(opts ...PoolOption) *BackendPool {
+	p := &BackendPool{
+		conns: make(map[poolKey]*pooledConn),
+		stop:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.idleTimeout > 0 {
+		go p.evictLoop(p.idleTimeout / 2)
+	}
+	return p
+}
+
+// Acquire returns a connection to target, dialing it if the pool does not hold one yet. The release function must be
+// called once the connection is no longer used; calling it more than once is harmless.
+//
+// Connections are shared between callers that use the same target and dial options. The options passed here are
+// added to the ones of the pool, and are compared by identity: create them once and reuse them, otherwise each call
+// dials a new connection.
+func (p *BackendPool) Acquire(ctx context.Context, target string, opts ...grpc.DialOption) (*grpc.ClientConn, func(), error) {
+	key := poolKey{target: target, opts: dialOptionsKey(opts)}
+
+	p.mu.Lock()
+	pc, err := p.lookupLocked(key)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if pc == nil {
+		// Dialing happens outside of the lock, as it may block if the options ask for it.
+		cc, err := grpc.DialContext(ctx, target, append(p.dialOpts[:len(p.dialOpts):len(p.dialOpts)], opts...)...)
+		if err != nil {
+			return nil, nil, status.Errorf(codes.Unavailable, "proxy: dialing %s: %v", target, err)
+		}
+		p.mu.Lock()
+		pc, err = p.lookupLocked(key)
+		if err == nil && pc == nil {
+			pc = &pooledConn{cc: cc, refs: 1, lastUsed: time.Now()}
+			p.conns[key] = pc
+			go p.watch(key, pc)
+			cc = nil
+		}
+		p.mu.Unlock()
+		if cc != nil {
+			// Somebody else was quicker, or the pool got closed.
+			cc.Close()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pc.cc, p.releaseFunc(pc), nil
+}
+
+// lookupLocked returns the usable connection for key with an extra reference, or nil if there is none.
+func (p *BackendPool) lookupLocked(key poolKey) (*pooledConn, error) {
+	if p.closed {
+		return nil, status.Errorf(codes.Unavailable, "proxy: backend pool is closed")
+	}
+	pc, ok := p.conns[key]
+	if !ok {
+		return nil, nil
+	}
+	if pc.cc.GetState() == connectivity.Shutdown {
+		delete(p.conns, key)
+		return nil, nil
+	}
+	pc.refs++
+	pc.lastUsed = time.Now()
+	return pc, nil
+}
+
+func (p *BackendPool) releaseFunc(pc *pooledConn) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			pc.refs--
+			pc.lastUsed = time.Now()
+		})
+	}
+}
+
+// TargetResolver returns the target of the backend a call should be forwarded to.
+type TargetResolver func(ctx context.Context, fullMethodName string) (string, error)
+
+// Director returns a StreamDirector forwarding each call to a pooled connection to the target returned by resolve.
+// The inbound metadata is forwarded, as with DefaultDirector, and the connection is released when the call ends.
+func (p *BackendPool) Director(resolve TargetResolver) StreamDirector {
+	return func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		target, err := resolve(ctx, fullMethodName)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p.direct(ctx, target)
+	}
+}
+
+// direct implements a StreamDirector forwarding the call in ctx to target.
+func (p *BackendPool) direct(ctx context.Context, target string) (context.Context, grpc.ClientConnInterface, error) {
+	cc, release, err := p.Acquire(ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The context of the inbound call is done once the handler returns.
+	context.AfterFunc(ctx, release)
+	md, _ := metadata.FromIncomingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, md.Copy()), cc, nil
+}
+
+// Len returns the number of connections held by the pool.
+func (p *BackendPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Close closes all connections of the pool, including ones still in use. Further calls to Acquire fail.
+func (p *BackendPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	var errs []string
+	for key, pc := range p.conns {
+		if err := pc.cc.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		delete(p.conns, key)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("proxy: closing backend pool: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *BackendPool) evictLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.evict(now)
+		}
+	}
+}
+
+// evict closes connections that are not in use and either idle for too long or failing.
+func (p *BackendPool) evict(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pc := range p.conns {
+		if pc.refs > 0 {
+			continue
+		}
+		state := pc.cc.GetState()
+		if state == connectivity.TransientFailure || state == connectivity.Shutdown || now.Sub(pc.lastUsed) >= p.idleTimeout {
+			pc.cc.Close()
+			delete(p.conns, key)
+		}
+	}
+}
+
+// watch closes pc once it fails while not in use, so that the next call dials the backend again. Failing connections
+// in use are closed once they fail again after being released, as they keep retrying to connect.
+func (p *BackendPool) watch(key poolKey, pc *pooledConn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for state := pc.cc.GetState(); state != connectivity.Shutdown; state = pc.cc.GetState() {
+		if state == connectivity.TransientFailure && p.closeUnused(key, pc) {
+			return
+		}
+		if !pc.cc.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+// closeUnused closes pc and removes it from the pool, unless it is in use.
+func (p *BackendPool) closeUnused(key poolKey, pc *pooledConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc.refs > 0 {
+		return false
+	}
+	if p.conns[key] == pc {
+		delete(p.conns, key)
+	}
+	pc.cc.Close()
+	return true
+}
+
+// dialOptionsKey identifies a set of dial options. grpc.DialOptions cannot be compared, so their identity is used.
+func dialOptionsKey(opts []grpc.DialOption) string {
+	var b strings.Builder
+	for _, opt := range opts {
+		v := reflect.ValueOf(opt)
+		if v.Kind() == reflect.Ptr {
+			fmt.Fprintf(&b, "%T@%x;", opt, v.Pointer())
+		} else {
+			fmt.Fprintf(&b, "%T:%v;", opt, opt)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,136 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// bufconnBackends starts a test backend for each of the names, and returns dial options connecting to the backend
+// named by the dialed target.
+func bufconnBackends(t *testing.T, names ...string) []grpc.DialOption {
+	t.Helper()
+	listeners := make(map[string]*bufconn.Listener)
+	for _, name := range names {
+		lis := bufconn.Listen(1 << 16)
+		srv := grpc.NewServer()
+		testservice.RegisterTestServiceServer(srv, testservice.DefaultTestServiceServer)
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		listeners[name] = lis
+	}
+	return []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, target string) (net.Conn, error) {
+			lis, ok := listeners[target]
+			if !ok {
+				return nil, status.Errorf(codes.NotFound, "no backend %q", target)
+			}
+			return lis.Dial()
+		}),
+	}
+}
+
+func TestBackendPool_SharesConnections(t *testing.T) {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "a", "b")...))
+	defer pool.Close()
+
+	ccA1, releaseA1, err := pool.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+	ccA2, releaseA2, err := pool.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+	ccB, releaseB, err := pool.Acquire(context.Background(), "b")
+	require.NoError(t, err)
+	defer releaseA1()
+	defer releaseA2()
+	defer releaseB()
+
+	assert.Same(t, ccA1, ccA2, "same target must share a connection")
+	assert.NotSame(t, ccA1, ccB, "different targets must not share a connection")
+
+	opt := grpc.WithUserAgent("pool-test")
+	ccOpt1, releaseOpt1, err := pool.Acquire(context.Background(), "a", opt)
+	require.NoError(t, err)
+	defer releaseOpt1()
+	ccOpt2, releaseOpt2, err := pool.Acquire(context.Background(), "a", opt)
+	require.NoError(t, err)
+	defer releaseOpt2()
+	assert.NotSame(t, ccA1, ccOpt1, "different dial options must not share a connection")
+	assert.Same(t, ccOpt1, ccOpt2, "same dial options must share a connection")
+	assert.Equal(t, 3, pool.Len())
+}
+
+func TestBackendPool_EvictsIdleConnections(t *testing.T) {
+	pool := proxy.NewBackendPool(
+		proxy.WithPoolDialOptions(bufconnBackends(t, "a")...),
+		proxy.WithPoolIdleTimeout(20*time.Millisecond),
+	)
+	defer pool.Close()
+
+	cc, release, err := pool.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, pool.Len(), "connections in use must not be evicted")
+
+	release()
+	release()
+	require.Eventually(t, func() bool { return pool.Len() == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, connectivity.Shutdown, cc.GetState())
+
+	again, release, err := pool.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+	defer release()
+	assert.NotSame(t, cc, again, "evicted connections are dialed again")
+}
+
+func TestBackendPool_ClosesFailedConnections(t *testing.T) {
+	// Without an idle timeout, only failing connections are closed.
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "a")...))
+	defer pool.Close()
+
+	failing, release, err := pool.Acquire(context.Background(), "missing")
+	require.NoError(t, err)
+	_, releaseWorking, err := pool.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+	releaseWorking()
+	require.Eventually(t, func() bool { return failing.GetState() == connectivity.TransientFailure }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, pool.Len(), "connections in use must not be closed")
+
+	release()
+	require.Eventually(t, func() bool { return pool.Len() == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, connectivity.Shutdown, failing.GetState())
+}
+
+func TestBackendPool_Close(t *testing.T) {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "a")...))
+	cc, _, err := pool.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+
+	require.NoError(t, pool.Close())
+	assert.Equal(t, connectivity.Shutdown, cc.GetState())
+	_, _, err = pool.Acquire(context.Background(), "a")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestBackendPool_Director(t *testing.T) {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "backend")...))
+	defer pool.Close()
+	director := pool.Director(func(ctx context.Context, fullMethodName string) (string, error) {
+		return "backend", nil
+	})
+
+	testservice.TestTestServiceServerImpl(t, directedTestClient(t, director))
+	assert.Equal(t, 1, pool.Len(), "all calls must share a single connection")
+}
@@ -17,9 +17,10 @@ func NewProxy(dst grpc.ClientConnInterface, opts ...grpc.ServerOption) *grpc.Ser
 	return grpc.NewServer(opts...)
 }
 
-// DefaultProxyOpt returns an grpc.UnknownServiceHandler with a DefaultDirector.
-func DefaultProxyOpt(cc grpc.ClientConnInterface) grpc.ServerOption {
-	return grpc.UnknownServiceHandler(TransparentHandler(DefaultDirector(cc)))
+// DefaultProxyOpt returns an grpc.UnknownServiceHandler with a DefaultDirector, configured with the given
+// HandlerOptions.
+func DefaultProxyOpt(cc grpc.ClientConnInterface, opts ...HandlerOption) grpc.ServerOption {
+	return grpc.UnknownServiceHandler(TransparentHandler(DefaultDirector(cc), opts...))
 }
 
 // DefaultDirector returns a very simple forwarding StreamDirector that forwards all
@@ -154,11 +154,17 @@ func backendDialer(t *testing.T, opts ...grpc.DialOption) (*grpc.ClientConn, err
 		return backendSvcDialer(t, *testBackend, opts...)
 	}
 
-	backendBc := bufconn.Listen(10)
 	// set up the backend using a "real" server over a bufconn
 	testSrv := grpc.NewServer()
 	testservice.RegisterTestServiceServer(testSrv, testservice.DefaultTestServiceServer)
+	return serverDialer(t, testSrv, opts...)
+}
+
+// serverDialer serves testSrv over a bufconn and returns a client connection to it.
+func serverDialer(t *testing.T, testSrv *grpc.Server, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	t.Helper()
 
+	backendBc := bufconn.Listen(10)
 	// run the test backend
 	go func() {
 		t.Log("Running testSrv")
@@ -189,6 +195,7 @@ func backendDialer(t *testing.T, opts ...grpc.DialOption) (*grpc.ClientConn, err
 	if err != nil {
 		return nil, fmt.Errorf("dialing backend: %v", err)
 	}
+	t.Cleanup(func() { backendCC.Close() })
 	return backendCC, nil
 }
 
@@ -209,3 +216,80 @@ func backendSvcDialer(t *testing.T, addr string, opts ...grpc.DialOption) (*grpc
 
 	return cc, nil
 }
+
+// proxyDialer serves proxySrv over a bufconn and returns a client connection to it.
+func proxyDialer(t *testing.T, proxySrv *grpc.Server) (*grpc.ClientConn, error) {
+	t.Helper()
+
+	proxyBc := bufconn.Listen(10)
+	go func() {
+		t.Log("Running proxySrv")
+		if err := proxySrv.Serve(proxyBc); err != nil {
+			if err == grpc.ErrServerStopped {
+				return
+			}
+			t.Logf("running proxy server: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		t.Log("Gracefully stopping proxySrv")
+		proxySrv.GracefulStop()
+	})
+
+	proxyCC, err := grpc.Dial(
+		"bufnet",
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return proxyBc.Dial()
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy: %v", err)
+	}
+	t.Cleanup(func() { proxyCC.Close() })
+	return proxyCC, nil
+}
+
+// testBackendConn serves svc, or the default test service if nil, and returns a client connection to it.
+func testBackendConn(t *testing.T, svc testservice.TestServiceServer) *grpc.ClientConn {
+	t.Helper()
+
+	var cc *grpc.ClientConn
+	var err error
+	if svc == nil {
+		cc, err = backendDialer(t)
+	} else {
+		srv := grpc.NewServer()
+		testservice.RegisterTestServiceServer(srv, svc)
+		cc, err = serverDialer(t, srv)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+// proxyTestClient returns a client calling the test service through a proxy handler configured with opts. Calls are
+// forwarded to svc, or to the default test service if nil, with the metadata of the client.
+func proxyTestClient(t *testing.T, svc testservice.TestServiceServer, opts ...proxy.HandlerOption) testservice.TestServiceClient {
+	t.Helper()
+
+	cc := testBackendConn(t, svc)
+	director := func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		return metadata.NewOutgoingContext(ctx, md.Copy()), cc, nil
+	}
+	return directedTestClient(t, director, opts...)
+}
+
+// directedTestClient is like proxyTestClient, but calls are forwarded as decided by director.
+func directedTestClient(t *testing.T, director proxy.StreamDirector, opts ...proxy.HandlerOption) testservice.TestServiceClient {
+	t.Helper()
+
+	proxyCC, err := proxyDialer(t, grpc.NewServer(grpc.UnknownServiceHandler(proxy.TransparentHandler(director, opts...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testservice.NewTestServiceClient(proxyCC)
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ReloadingRouter is a StreamDirector routing calls with a Router whose configuration can be replaced at runtime,
+// without restarting the grpc.Server.
+//
+// A new configuration only applies to calls started after it was loaded, while calls in flight finish on the
+// backends they were routed to. Invalid configurations are rejected and the previous one stays active.
+type ReloadingRouter struct {
+	pool   *BackendPool
+	opts   []RouterOption
+	active atomic.Pointer[Router]
+
+	mu    sync.Mutex
+	stats ReloadStats
+}
+
+// ReloadStats describes the reload history of a ReloadingRouter.
+type ReloadStats struct {
+	// Version is incremented with every configuration that becomes active, starting at 1 for the initial one.
+	Version uint64
+	// Successes and Failures count the reloads that were applied and rejected, respectively.
+	Successes uint64
+	Failures  uint64
+	// LastReload is the time of the last reload attempt, successful or not.
+	LastReload time.Time
+	// LastError is the error of the last reload attempt, nil if it was successful.
+	LastError error
+}
+
+// NewReloadingRouter creates a ReloadingRouter with an initial configuration, which must be valid. Connections to
+// backends are taken from pool across all configurations, and opts apply to all of them.
+func NewReloadingRouter(cfg *RouterConfig, pool *BackendPool, opts ...RouterOption) (*ReloadingRouter, error) {
+	router, err := NewRouter(cfg, pool, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReloadingRouter{pool: pool, opts: opts}
+	r.active.Store(router)
+	r.stats = ReloadStats{Version: 1, LastReload: time.Now()}
+	return r, nil
+}
+
+// Director implements a StreamDirector using the currently active configuration.
+func (r *ReloadingRouter) Director(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+	return r.active.Load().Director(ctx, fullMethodName)
+}
+
+// Router returns the Router of the currently active configuration.
+func (r *ReloadingRouter) Router() *Router {
+	return r.active.Load()
+}
+
+// ServiceBackends is like Router.ServiceBackends, using the currently active configuration. It can be given to
+// NewHealthServer, which then follows reloads.
+func (r *ReloadingRouter) ServiceBackends(service string) []string {
+	return r.active.Load().ServiceBackends(service)
+}
+
+// Update validates cfg and makes it the active configuration. If cfg is invalid, the error is returned and the
+// previous configuration stays active.
+func (r *ReloadingRouter) Update(cfg *RouterConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateLocked(cfg, nil)
+}
+
+// ReloadFile loads the configuration from a YAML or JSON file and makes it the active one, as with Update.
+func (r *ReloadingRouter) ReloadFile(path string) error {
+	cfg, err := LoadRouterConfig(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateLocked(cfg, err)
+}
+
+func (r *ReloadingRouter) updateLocked(cfg *RouterConfig, err error) error {
+	var router *Router
+	if err == nil {
+		router, err = NewRouter(cfg, r.pool, r.opts...)
+	}
+	r.stats.LastReload = time.Now()
+	r.stats.LastError = err
+	if err != nil {
+		r.stats.Failures++
+		return err
+	}
+	r.active.Store(router)
+	r.stats.Successes++
+	r.stats.Version++
+	return nil
+}
+
+// Stats returns the reload history of the router.
+func (r *ReloadingRouter) Stats() ReloadStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// WatchFile polls the configuration file at path every interval and reloads it whenever its contents change. It
+// blocks until ctx is done and returns its error.
+//
+// Contents equal to the active configuration are not reloaded. A file that cannot be read or holds an invalid
+// configuration counts as one failed reload, until its contents change again.
+func (r *ReloadingRouter) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last [sha256.Size]byte
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(path)
+		var sum [sha256.Size]byte
+		if err != nil {
+			err = fmt.Errorf("proxy: reading router config: %v", err)
+			sum = sha256.Sum256([]byte(err.Error()))
+		} else {
+			sum = sha256.Sum256(data)
+		}
+		if sum == last {
+			continue
+		}
+		last = sum
+		var cfg *RouterConfig
+		if err == nil {
+			cfg, err = ParseRouterConfig(data)
+		}
+		if err == nil && reflect.DeepEqual(cfg, r.active.Load().cfg) {
+			// Most likely the configuration the router was created with.
+			continue
+		}
+		r.mu.Lock()
+		r.updateLocked(cfg, err)
+		r.mu.Unlock()
+	}
+}
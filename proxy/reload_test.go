@@ -0,0 +1,97 @@
+package proxy_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+func reloadTestConfig(defaultBackend string) string {
+	return "backends:\n  a: {target: a}\n  b: {target: b}\ndefault_backend: " + defaultBackend + "\n"
+}
+
+func TestReloadingRouter_WatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(reloadTestConfig("a")), 0o644))
+	cfg, err := proxy.LoadRouterConfig(path)
+	require.NoError(t, err)
+	router, err := proxy.NewReloadingRouter(cfg, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchErr := make(chan error)
+	go func() { watchErr <- router.WatchFile(ctx, path, 5*time.Millisecond) }()
+	defer func() {
+		cancel()
+		assert.Equal(t, context.Canceled, <-watchErr)
+	}()
+
+	backend := func() string {
+		b, err := router.Router().Match(context.Background(), "/any.Service/Method")
+		require.NoError(t, err)
+		return b
+	}
+	assert.Equal(t, "a", backend())
+
+	require.NoError(t, os.WriteFile(path, []byte(reloadTestConfig("b")), 0o644))
+	require.Eventually(t, func() bool { return backend() == "b" }, time.Second, 5*time.Millisecond)
+	stats := router.Stats()
+	assert.Equal(t, uint64(2), stats.Version)
+	assert.Equal(t, uint64(1), stats.Successes)
+	assert.NoError(t, stats.LastError)
+
+	require.NoError(t, os.WriteFile(path, []byte(reloadTestConfig("c")), 0o644))
+	require.Eventually(t, func() bool { return router.Stats().Failures == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	stats = router.Stats()
+	assert.Equal(t, uint64(1), stats.Failures, "unchanged invalid configs must not be retried")
+	assert.Error(t, stats.LastError)
+	assert.Equal(t, uint64(2), stats.Version)
+	assert.Equal(t, "b", backend(), "invalid configs must keep the previous one active")
+}
+
+func TestReloadingRouter_InFlightStreamsSurviveReload(t *testing.T) {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "a", "b")...))
+	defer pool.Close()
+	cfg, err := proxy.ParseRouterConfig([]byte(reloadTestConfig("a")))
+	require.NoError(t, err)
+	router, err := proxy.NewReloadingRouter(cfg, pool)
+	require.NoError(t, err)
+
+	client := directedTestClient(t, router.Director)
+
+	stream, err := client.PingStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "before"}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	next, err := proxy.ParseRouterConfig([]byte(reloadTestConfig("b")))
+	require.NoError(t, err)
+	require.NoError(t, router.Update(next))
+	bad, err := proxy.ParseRouterConfig([]byte(reloadTestConfig("c")))
+	require.NoError(t, err)
+	assert.Error(t, router.Update(bad))
+
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "after"}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "after", resp.Value)
+	assert.EqualValues(t, 1, resp.Counter, "the stream must stay on its original backend")
+	require.NoError(t, stream.CloseSend())
+
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "new"})
+	require.NoError(t, err)
+	stats := router.Stats()
+	assert.Equal(t, uint64(2), stats.Version)
+	assert.Equal(t, uint64(1), stats.Successes)
+	assert.Equal(t, uint64(1), stats.Failures)
+}
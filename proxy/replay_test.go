@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// endlessStream is a client sending 10 byte messages as fast as they are received.
+type endlessStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	received atomic.Int32
+}
+
+func (s *endlessStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *endlessStream) RecvMsg(m interface{}) error {
+	s.received.Add(1)
+	m.(proto.Message).ProtoReflect().SetUnknown(make([]byte, 10))
+	return nil
+}
+
+func TestReplayBuffer_ReadsAtReaderPaceBeyondLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &endlessStream{ctx: ctx}
+	buf := newReplayBuffer(25)
+	done := make(chan struct{})
+	go func() {
+		buf.fill(src)
+		close(done)
+	}()
+
+	// The third message exceeds the limit, after which the client waits for the slow reader.
+	require.Eventually(t, func() bool { return src.received.Load() == 3 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.EqualValues(t, 3, src.received.Load())
+	assert.False(t, buf.replayable())
+
+	for i := 0; i < 5; i++ {
+		payload, err := buf.next(ctx, i)
+		require.NoError(t, err)
+		assert.Len(t, payload, 10)
+	}
+	require.Eventually(t, func() bool { return src.received.Load() == 6 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.EqualValues(t, 6, src.received.Load(), "only one message is read ahead of the reader")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fill did not return once the call ended")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDKey is the metadata key carrying request IDs unless configured otherwise.
+const RequestIDKey = "x-request-id"
+
+// RequestIDs configures how the proxy identifies calls, to correlate what clients, the proxy and backends see.
+//
+// Every call keeps the request ID sent by its client, or is assigned a new one. The request ID is sent to the backend,
+// echoed to the client in the response headers, and available to directors and hooks via RequestIDFromContext.
+type RequestIDs struct {
+	// Key is the metadata key carrying request IDs, RequestIDKey by default.
+	Key string
+	// Generate returns a new request ID. By default, request IDs are random UUIDs.
+	Generate func() string
+}
+
+// WithRequestIDs makes the handler assign request IDs to calls as configured by ids.
+func WithRequestIDs(ids RequestIDs) HandlerOption {
+	return func(o *handlerOptions) {
+		if ids.Key == "" {
+			ids.Key = RequestIDKey
+		}
+		if ids.Generate == nil {
+			ids.Generate = newUUID
+		}
+		o.requestIDs = &ids
+	}
+}
+
+type requestIDCtxKey struct{}
+
+type requestID struct {
+	key, id string
+}
+
+// RequestIDFromContext returns the request ID of the proxied call ctx belongs to, if the handler assigns request IDs.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	r, ok := ctx.Value(requestIDCtxKey{}).(requestID)
+	return r.id, ok
+}
+
+// assign returns ctx carrying the request ID of the call on serverStream, and the stream the call is to be proxied
+// with.
+func (r *RequestIDs) assign(ctx context.Context, serverStream grpc.ServerStream) (context.Context, grpc.ServerStream) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if vals := md.Get(r.Key); len(vals) > 0 {
+		id = vals[0]
+	}
+	if id == "" {
+		id = r.Generate()
+	}
+	// Headers set now are sent even if the call fails before the backend sends its own.
+	serverStream.SetHeader(metadata.Pairs(r.Key, id))
+	return context.WithValue(ctx, requestIDCtxKey{}, requestID{key: r.Key, id: id}), &requestIDStream{ServerStream: serverStream, key: r.Key}
+}
+
+// withRequestID returns outCtx with the request ID of the call in inCtx set in its outgoing metadata.
+func withRequestID(inCtx, outCtx context.Context) context.Context {
+	r, ok := inCtx.Value(requestIDCtxKey{}).(requestID)
+	if !ok {
+		return outCtx
+	}
+	md, _ := metadata.FromOutgoingContext(outCtx)
+	md = md.Copy()
+	md.Set(r.key, r.id)
+	return metadata.NewOutgoingContext(outCtx, md)
+}
+
+// requestIDStream keeps backends from echoing the request ID to the client a second time.
+type requestIDStream struct {
+	grpc.ServerStream
+	key string
+}
+
+func (s *requestIDStream) SendHeader(md metadata.MD) error {
+	if len(md.Get(s.key)) > 0 {
+		md = md.Copy()
+		delete(md, s.key)
+	}
+	return s.ServerStream.SendHeader(md)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("proxy: reading random bytes: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,96 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// requestIDService records the request IDs it receives, and echoes them back in its response headers.
+type requestIDService struct {
+	testservice.TestServiceServer
+	key      string
+	received chan string
+}
+
+func (s *requestIDService) Ping(ctx context.Context, req *testservice.PingRequest) (*testservice.PingResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ids := md.Get(s.key)
+	for _, id := range ids {
+		s.received <- id
+	}
+	grpc.SendHeader(ctx, metadata.Pairs(s.key, "echoed by the backend"))
+	return &testservice.PingResponse{Value: req.Value}, nil
+}
+
+// requestIDDirector forwards calls to a requestIDService for the request IDs carried by key, without the metadata of
+// the client, and rejects PingError calls. The request IDs it sees are sent on the returned channel.
+func requestIDDirector(t *testing.T, key string) (proxy.StreamDirector, *requestIDService, chan string) {
+	t.Helper()
+	svc := &requestIDService{key: key, received: make(chan string, 10)}
+	cc := testBackendConn(t, svc)
+	seen := make(chan string, 10)
+	director := func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		id, ok := proxy.RequestIDFromContext(ctx)
+		assert.True(t, ok)
+		seen <- id
+		if fullMethodName == "/mwitkow.testproto.TestService/PingError" {
+			return nil, nil, status.Error(codes.PermissionDenied, "rejected")
+		}
+		return ctx, cc, nil
+	}
+	return director, svc, seen
+}
+
+func TestRequestIDs_Generated(t *testing.T) {
+	director, svc, seen := requestIDDirector(t, proxy.RequestIDKey)
+	client := directedTestClient(t, director, proxy.WithRequestIDs(proxy.RequestIDs{}))
+
+	header := metadata.MD{}
+	_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+	require.NoError(t, err)
+
+	id := <-seen
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	assert.Equal(t, id, <-svc.received)
+	assert.Equal(t, []string{id}, header.Get(proxy.RequestIDKey))
+
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.NotEqual(t, id, <-seen)
+}
+
+func TestRequestIDs_FromClient(t *testing.T) {
+	director, svc, seen := requestIDDirector(t, proxy.RequestIDKey)
+	client := directedTestClient(t, director, proxy.WithRequestIDs(proxy.RequestIDs{}))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), proxy.RequestIDKey, "client-id")
+	header := metadata.MD{}
+	_, err := client.Ping(ctx, &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+	require.NoError(t, err)
+
+	assert.Equal(t, "client-id", <-seen)
+	assert.Equal(t, "client-id", <-svc.received)
+	assert.Equal(t, []string{"client-id"}, header.Get(proxy.RequestIDKey))
+}
+
+func TestRequestIDs_CustomKeyAndFailedCall(t *testing.T) {
+	director, _, seen := requestIDDirector(t, "x-correlation-id")
+	client := directedTestClient(t, director, proxy.WithRequestIDs(proxy.RequestIDs{Key: "x-correlation-id", Generate: func() string { return "generated" }}))
+
+	header := metadata.MD{}
+	_, err := client.PingError(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, "generated", <-seen)
+	assert.Equal(t, []string{"generated"}, header.Get("x-correlation-id"))
+	assert.Empty(t, header.Get(proxy.RequestIDKey))
+}
@@ -0,0 +1,394 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// previousAttemptsKey is the metadata key telling the backend how many times the call was attempted before.
+	previousAttemptsKey = "grpc-previous-rpc-attempts"
+	// retryPushbackKey is the trailer a backend can use to delay retries, or to prevent them with a negative value.
+	retryPushbackKey = "grpc-retry-pushback-ms"
+)
+
+// RetryPolicy makes the handler transparently retry calls to the methods it matches, when they fail before anything
+// of the response was sent to the client.
+//
+// To be able to replay them, the messages of the client are buffered until the first header or message of the
+// response is sent to the client. Calls whose messages exceed the buffer limit are forwarded as usual, but cannot be
+// retried anymore. The director is asked for a backend again on every attempt, and can steer retries away from the
+// backends that failed, see StreamInfo.PreviousBackends. Frame interceptors see the client messages again on every
+// attempt, see StreamInfo.Attempt.
+type RetryPolicy struct {
+	// Method is a pattern matched against the full method name, with the same syntax as TimeoutRule.Method.
+	Method string
+	// MaxAttempts is the maximum number of attempts, including the first one. It defaults to 3.
+	MaxAttempts int
+	// RetryableCodes are the status codes that are retried, by default only Unavailable.
+	RetryableCodes []codes.Code
+	// BufferLimit is the maximum number of bytes of client messages buffered for retries, 64 KiB by default.
+	BufferLimit int
+	// The delay before each retry is picked at random between zero and InitialBackoff, 50ms by default, multiplied by
+	// BackoffMultiplier, 2 by default, for each previous retry, but at most MaxBackoff, 1 second by default. Backends
+	// can override the delay with the `grpc-retry-pushback-ms` trailer.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+}
+
+// WithRetries enables transparent retries with the given RetryPolicies. Policies are evaluated in order and only the
+// first policy matching a method applies.
+func WithRetries(policies ...RetryPolicy) HandlerOption {
+	return func(o *handlerOptions) {
+		o.retries = append(o.retries, policies...)
+	}
+}
+
+// WithRetryBudget limits retries across all calls of the handler, as with the retry throttling of gRPC clients. The
+// budget starts with maxTokens tokens. Every attempt failing with a retryable code takes one token and every
+// successful call with retries enabled gives back tokenRatio tokens. Calls are only retried while more than half of
+// the tokens are left.
+func WithRetryBudget(maxTokens, tokenRatio float64) HandlerOption {
+	return func(o *handlerOptions) {
+		o.retryBudget = &retryBudget{max: maxTokens, ratio: tokenRatio, tokens: maxTokens}
+	}
+}
+
+func (o *handlerOptions) retryPolicy(fullMethodName string) *RetryPolicy {
+	for i := range o.retries {
+		if matchMethod(o.retries[i].Method, fullMethodName) {
+			return &o.retries[i]
+		}
+	}
+	return nil
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(code codes.Code) bool {
+	if len(p.RetryableCodes) == 0 {
+		return code == codes.Unavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) bufferLimit() int {
+	if p.BufferLimit == 0 {
+		return 64 << 10
+	}
+	return p.BufferLimit
+}
+
+// backoff returns the delay before the retry following attempt, counted from 0.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.BackoffMultiplier
+	if initial == 0 {
+		initial = 50 * time.Millisecond
+	}
+	if max == 0 {
+		max = time.Second
+	}
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	limit := math.Min(float64(initial)*math.Pow(multiplier, float64(attempt)), float64(max))
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+type retryBudget struct {
+	max, ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func (b *retryBudget) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Max(b.tokens-1, 0)
+}
+
+func (b *retryBudget) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.max)
+}
+
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens > b.max/2
+}
+
+// withPreviousAttempts sets the number of previous attempts of the call in the outgoing metadata, adding the attempts
+// made before the call reached the proxy.
+func withPreviousAttempts(inCtx, outCtx context.Context, attempt int) context.Context {
+	inMd, _ := metadata.FromIncomingContext(inCtx)
+	if vals := inMd.Get(previousAttemptsKey); len(vals) > 0 {
+		if n, err := strconv.Atoi(vals[0]); err == nil && n > 0 {
+			attempt += n
+		}
+	}
+	outMd, _ := metadata.FromOutgoingContext(outCtx)
+	outMd = outMd.Copy()
+	outMd.Set(previousAttemptsKey, strconv.Itoa(attempt))
+	return metadata.NewOutgoingContext(outCtx, outMd)
+}
+
+// proxyWithRetries forwards the call like proxy, attempting it again on retryable failures.
+func (s *handler) proxyWithRetries(ctx context.Context, serverStream grpc.ServerStream, fullMethodName string, policy *RetryPolicy) error {
+	buf := newReplayBuffer(policy.bufferLimit())
+	go buf.fill(serverStream)
+	info, _ := StreamInfoFromContext(ctx)
+	for attempt := 0; ; attempt++ {
+		stream := &replayStream{ServerStream: serverStream, buf: buf}
+		b, err := s.openBackend(ctx, fullMethodName, attempt)
+		if err == nil {
+			stream.ctx = b.ctx
+			err = b.explain(s.forward(ctx, stream, b.stream, fullMethodName, b.activity, func() { b.cancel(nil) }))
+			b.close()
+			b.finish(err)
+		}
+		delay, retry := s.shouldRetry(ctx, policy, attempt, buf, err, stream.trailer)
+		if !retry {
+			serverStream.SetTrailer(stream.trailer)
+			if err == nil {
+				s.opts.retryBudget.success()
+			}
+			return err
+		}
+		info.nextAttempt()
+		if !sleepContext(ctx, delay) {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// shouldRetry decides whether an attempt that ended with err is retried, and after which delay.
+func (s *handler) shouldRetry(ctx context.Context, policy *RetryPolicy, attempt int, buf *replayBuffer, err error, trailer metadata.MD) (time.Duration, bool) {
+	var abortErr *frameAbortError
+	if err == nil || ctx.Err() != nil || buf.committed.Load() || buf.clientFailed() || errors.As(err, &abortErr) {
+		return 0, false
+	}
+	if !policy.retryable(status.Code(err)) {
+		return 0, false
+	}
+	s.opts.retryBudget.failure()
+	if attempt+1 >= policy.maxAttempts() || !buf.replayable() || !s.opts.retryBudget.allow() {
+		return 0, false
+	}
+	delay := policy.backoff(attempt)
+	if vals := trailer.Get(retryPushbackKey); len(vals) > 0 {
+		ms, err := strconv.Atoi(vals[0])
+		if err != nil || ms < 0 {
+			return 0, false
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+	return delay, true
+}
+
+// replayBuffer reads the messages of the client of a call, and keeps them for replaying to several backends until the
+// call is committed to one of them.
+type replayBuffer struct {
+	limit     int
+	committed atomic.Bool
+
+	mu sync.Mutex
+	// frames holds the messages of the client from the one with index first on.
+	frames [][]byte
+	first  int
+	size   int
+	// retain is false once messages no longer need to be replayed and can be dropped as soon as they were read.
+	retain bool
+	// err is the error that ended the messages of the client, io.EOF if it closed its side of the stream.
+	err error
+	// changed is closed and replaced whenever a message or the error is added, or messages are dropped.
+	changed chan struct{}
+}
+
+func newReplayBuffer(limit int) *replayBuffer {
+	return &replayBuffer{limit: limit, retain: true, changed: make(chan struct{})}
+}
+
+// fill reads the messages of the client from src until it ends its side of the stream, or the call ends. Once
+// messages are no longer retained, the next one is only read after the reader caught up, so that the client is not
+// read faster than the backend.
+func (b *replayBuffer) fill(src grpc.ServerStream) {
+	for b.waitForReader(src.Context()) {
+		f := &emptypb.Empty{}
+		err := src.RecvMsg(f)
+		b.mu.Lock()
+		if err != nil {
+			b.err = err
+		} else {
+			payload := f.ProtoReflect().GetUnknown()
+			b.frames = append(b.frames, payload)
+			if b.size += len(payload); b.size > b.limit {
+				b.retain = false
+			}
+		}
+		b.notifyLocked()
+		b.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitForReader waits until no message that is no longer retained is left to read, and reports whether ctx is still
+// not done.
+func (b *replayBuffer) waitForReader(ctx context.Context) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.retain && len(b.frames) > 0 {
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			return false
+		case <-changed:
+		}
+		b.mu.Lock()
+	}
+	return true
+}
+
+// notifyLocked wakes up everyone waiting for the buffer to change.
+func (b *replayBuffer) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// next returns the message of the client with index i, waiting for it. Once all messages were returned, it returns
+// the error that ended them.
+func (b *replayBuffer) next(ctx context.Context, i int) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if i < b.first {
+			return nil, status.Errorf(codes.Internal, "proxy: message %d of the client is no longer buffered", i)
+		}
+		if j := i - b.first; j < len(b.frames) {
+			payload := b.frames[j]
+			if !b.retain {
+				// Only a single reader is left, which will not come back for this or earlier messages.
+				b.frames = b.frames[j+1:]
+				b.first = i + 1
+				b.notifyLocked()
+			}
+			return payload, nil
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			return nil, ctx.Err()
+		case <-changed:
+		}
+		b.mu.Lock()
+	}
+}
+
+// commit marks the call as committed to the current attempt, after which messages are no longer replayed.
+func (b *replayBuffer) commit() {
+	if b.committed.Swap(true) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retain = false
+}
+
+// replayable reports whether all messages of the client can still be replayed.
+func (b *replayBuffer) replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retain && b.first == 0
+}
+
+// clientFailed reports whether reading from the client failed, other than by the client closing its side.
+func (b *replayBuffer) clientFailed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err != nil && b.err != io.EOF
+}
+
+// replayStream is the grpc.ServerStream an attempt of a retried call is forwarded with. It receives the messages of
+// the client from a replayBuffer, commits the call once something is sent to the client, and holds back trailers
+// until the handler knows which attempt is the last one.
+type replayStream struct {
+	grpc.ServerStream
+	buf     *replayBuffer
+	ctx     context.Context
+	next    int
+	trailer metadata.MD
+}
+
+func (r *replayStream) RecvMsg(m interface{}) error {
+	payload, err := r.buf.next(r.ctx, r.next)
+	if err != nil {
+		return err
+	}
+	r.next++
+	msg := m.(proto.Message).ProtoReflect()
+	msg.SetUnknown(append(protoreflect.RawFields(nil), payload...))
+	return nil
+}
+
+func (r *replayStream) SendHeader(md metadata.MD) error {
+	r.buf.commit()
+	return r.ServerStream.SendHeader(md)
+}
+
+func (r *replayStream) SendMsg(m interface{}) error {
+	r.buf.commit()
+	return r.ServerStream.SendMsg(m)
+}
+
+func (r *replayStream) SetTrailer(md metadata.MD) {
+	r.trailer = metadata.Join(r.trailer, md)
+}
@@ -0,0 +1,167 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// failingService fails all calls with err, counting them. PingList sends a message before failing.
+type failingService struct {
+	testservice.TestServiceServer
+	err     error
+	trailer metadata.MD
+	calls   atomic.Int32
+}
+
+func (s *failingService) Ping(ctx context.Context, _ *testservice.PingRequest) (*testservice.PingResponse, error) {
+	s.calls.Add(1)
+	grpc.SetTrailer(ctx, s.trailer)
+	return nil, s.err
+}
+
+func (s *failingService) PingList(_ *testservice.PingRequest, stream testservice.TestService_PingListServer) error {
+	s.calls.Add(1)
+	if err := stream.Send(&testservice.PingResponse{Value: "partial"}); err != nil {
+		return err
+	}
+	return s.err
+}
+
+func (s *failingService) PingStream(stream testservice.TestService_PingStreamServer) error {
+	s.calls.Add(1)
+	return s.err
+}
+
+// retryDirector forwards calls round-robin to a failing backend and a working one. As retries advance the round-robin
+// too, every call is first sent to the failing backend.
+func retryDirector(t *testing.T, failing *failingService) proxy.StreamDirector {
+	t.Helper()
+	b, err := proxy.NewBalancer(proxy.RoundRobin, []string{"working", "failing"})
+	require.NoError(t, err)
+	conns := map[string]grpc.ClientConnInterface{"failing": testBackendConn(t, failing), "working": testBackendConn(t, nil)}
+	return proxy.BalancingDirector(b, conns)
+}
+
+func TestRetries_RetriesOnAnotherBackend(t *testing.T) {
+	failing := &failingService{err: status.Error(codes.Unavailable, "overloaded")}
+	client := directedTestClient(t, retryDirector(t, failing), proxy.WithRetries(proxy.RetryPolicy{}))
+
+	for i := 0; i < 4; i++ {
+		header := metadata.MD{}
+		resp, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value)
+		// The test service echoes the metadata it received.
+		assert.Equal(t, []string{"1"}, header.Get("grpc-previous-rpc-attempts"))
+	}
+	assert.EqualValues(t, 4, failing.calls.Load())
+
+	// Messages of the client are replayed to the second backend.
+	stream, err := client.PingStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "one"}))
+	require.NoError(t, stream.Send(&testservice.PingRequest{Value: "two"}))
+	for _, want := range []string{"one", "two"} {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, want, resp.Value)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.EqualValues(t, 5, failing.calls.Load())
+}
+
+func TestRetries_NotRetried(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		err     error
+		trailer metadata.MD
+		opts    []proxy.HandlerOption
+	}{
+		{
+			name: "non-retryable code",
+			err:  status.Error(codes.Unavailable, "overloaded"),
+			opts: []proxy.HandlerOption{proxy.WithRetries(proxy.RetryPolicy{RetryableCodes: []codes.Code{codes.ResourceExhausted}})},
+		},
+		{
+			name: "other method",
+			err:  status.Error(codes.Unavailable, "overloaded"),
+			opts: []proxy.HandlerOption{proxy.WithRetries(proxy.RetryPolicy{Method: "/other.Service/*"})},
+		},
+		{
+			name: "buffer limit exceeded",
+			err:  status.Error(codes.Unavailable, "overloaded"),
+			opts: []proxy.HandlerOption{proxy.WithRetries(proxy.RetryPolicy{BufferLimit: 1})},
+		},
+		{
+			name:    "pushback",
+			err:     status.Error(codes.Unavailable, "overloaded"),
+			trailer: metadata.Pairs("grpc-retry-pushback-ms", "-1"),
+			opts:    []proxy.HandlerOption{proxy.WithRetries(proxy.RetryPolicy{})},
+		},
+		{
+			name: "budget exhausted",
+			err:  status.Error(codes.Unavailable, "overloaded"),
+			opts: []proxy.HandlerOption{proxy.WithRetries(proxy.RetryPolicy{}), proxy.WithRetryBudget(1, 0.1)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failing := &failingService{err: tc.err, trailer: tc.trailer}
+			client := directedTestClient(t, retryDirector(t, failing), tc.opts...)
+			_, err := client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+			assert.Equal(t, codes.Unavailable, status.Code(err))
+			assert.EqualValues(t, 1, failing.calls.Load())
+		})
+	}
+}
+
+func TestRetries_NotAfterResponseStarted(t *testing.T) {
+	failing := &failingService{err: status.Error(codes.Unavailable, "overloaded")}
+	client := directedTestClient(t, retryDirector(t, failing), proxy.WithRetries(proxy.RetryPolicy{}))
+
+	stream, err := client.PingList(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "partial", resp.Value)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.EqualValues(t, 1, failing.calls.Load())
+}
+
+func TestRetries_FailedAttemptsReleaseBackends(t *testing.T) {
+	failing := &failingService{err: status.Error(codes.Unavailable, "overloaded")}
+	b, err := proxy.NewBalancer(proxy.RoundRobin, []string{"working", "failing"})
+	require.NoError(t, err)
+	balanced := proxy.BalancingDirector(b, map[string]grpc.ClientConnInterface{"failing": testBackendConn(t, failing), "working": testBackendConn(t, nil)})
+	var mu sync.Mutex
+	var inFlight []int64
+	director := func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+		mu.Lock()
+		inFlight = append(inFlight, b.Outstanding("failing"))
+		mu.Unlock()
+		return balanced(ctx, fullMethodName)
+	}
+	client := directedTestClient(t, director, proxy.WithRetries(proxy.RetryPolicy{}))
+
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []int64{0, 0}, inFlight, "failed attempts must not stay in flight")
+	assert.EqualValues(t, 1, failing.calls.Load())
+}
@@ -0,0 +1,406 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// RouterConfig is a declarative definition of backends and of the routes mapping proxied calls to them.
+//
+// It can be written in YAML or JSON, e.g.:
+//
+//	backends:
+//	  users: {target: "dns:///users.svc.local:443"}
+//	  legacy: {target: "legacy.svc.local:443"}
+//	routes:
+//	  - name: users-api
+//	    match: {method_prefix: "/example.users.v1."}
+//	    backend: users
+//	  - match: {authority: "*.legacy.example.com", metadata: {x-tenant: "acme"}}
+//	    backends: [legacy, users]
+//	    balancing: least_outstanding
+//	default_backend: legacy
+type RouterConfig struct {
+	// Backends maps backend names to their definitions.
+	Backends map[string]BackendConfig `json:"backends" yaml:"backends"`
+	// Routes are evaluated in order and the first matching route decides the backend of a call.
+	Routes []RouteConfig `json:"routes" yaml:"routes"`
+	// DefaultBackend receives calls that match no route. If empty, such calls fail with Unimplemented.
+	DefaultBackend string `json:"default_backend,omitempty" yaml:"default_backend,omitempty"`
+}
+
+// BackendConfig defines a backend calls can be routed to.
+type BackendConfig struct {
+	// Target is the gRPC dial target of the backend, e.g. "dns:///users.svc.local:443".
+	Target string `json:"target" yaml:"target"`
+}
+
+// RouteConfig maps the calls it matches to a backend, or balances them across several ones.
+type RouteConfig struct {
+	// Name identifies the route in errors. It defaults to the position of the route.
+	Name  string     `json:"name,omitempty" yaml:"name,omitempty"`
+	Match RouteMatch `json:"match" yaml:"match"`
+	// Backend is the backend receiving the calls. Exactly one of Backend and Backends must be set.
+	Backend string `json:"backend,omitempty" yaml:"backend,omitempty"`
+	// Backends are balanced according to Balancing, round-robin by default.
+	Backends  []string        `json:"backends,omitempty" yaml:"backends,omitempty"`
+	Balancing BalancingPolicy `json:"balancing,omitempty" yaml:"balancing,omitempty"`
+	// HashKey is the metadata key used by the consistent_hash balancing policy.
+	HashKey string `json:"hash_key,omitempty" yaml:"hash_key,omitempty"`
+}
+
+// RouteMatch holds the conditions a call has to meet to match a route. All set conditions must be met; an empty
+// RouteMatch matches all calls. At most one of the method conditions can be set.
+type RouteMatch struct {
+	// Method matches the full method name, e.g. "/package.service/method", exactly.
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+	// MethodPrefix matches full method names starting with it, e.g. "/package.service/".
+	MethodPrefix string `json:"method_prefix,omitempty" yaml:"method_prefix,omitempty"`
+	// MethodGlob matches full method names using path.Match syntax, e.g. "/package.*/Get*".
+	MethodGlob string `json:"method_glob,omitempty" yaml:"method_glob,omitempty"`
+	// MethodRegex matches full method names against a regular expression, anchored at both ends.
+	MethodRegex string `json:"method_regex,omitempty" yaml:"method_regex,omitempty"`
+	// Authority matches the `:authority` of the call using path.Match syntax, e.g. "*.example.com".
+	Authority string `json:"authority,omitempty" yaml:"authority,omitempty"`
+	// Metadata matches calls carrying all of the given metadata keys, with one of their values equal to the one
+	// given. An empty value only requires the key to be present.
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// ParseRouterConfig parses a RouterConfig from YAML or JSON.
+func ParseRouterConfig(data []byte) (*RouterConfig, error) {
+	cfg := &RouterConfig{}
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("proxy: parsing router config: %v", err)
+	}
+	return cfg, nil
+}
+
+// LoadRouterConfig reads a RouterConfig from a YAML or JSON file.
+func LoadRouterConfig(path string) (*RouterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: reading router config: %v", err)
+	}
+	return ParseRouterConfig(data)
+}
+
+// Validate checks that the configuration is complete and consistent. All problems found are reported.
+func (c *RouterConfig) Validate() error {
+	_, err := compileRoutes(c)
+	return err
+}
+
+// Router is a StreamDirector built from a RouterConfig, forwarding calls to the backend of the first matching route
+// using the connections of a BackendPool.
+type Router struct {
+	cfg     *RouterConfig
+	routes  []*compiledRoute
+	pool    *BackendPool
+	healthy func(backend string) bool
+	service func(backend, service string) bool
+}
+
+// RouterOption configures a Router.
+type RouterOption func(*Router)
+
+// WithRouterHealth sets the function reporting whether a backend is healthy, such as OutlierDetector.Healthy.
+// Balanced routes skip unhealthy backends, while calls routed to a single unhealthy backend fail with Unavailable.
+func WithRouterHealth(healthy func(backend string) bool) RouterOption {
+	return func(r *Router) {
+		r.healthy = healthy
+	}
+}
+
+// WithRouterServiceHealth sets the function reporting whether a backend is healthy for a service, such as
+// HealthChecker.ServiceHealthy. Backends unhealthy for the service of a call are handled as with WithRouterHealth.
+func WithRouterServiceHealth(healthy func(backend, service string) bool) RouterOption {
+	return func(r *Router) {
+		r.service = healthy
+	}
+}
+
+// NewRouter validates the configuration and builds a Router from it. Connections to backends are taken from pool,
+// which may only be nil for a Router used to Match calls, as its Director then fails all calls.
+func NewRouter(cfg *RouterConfig, pool *BackendPool, opts ...RouterOption) (*Router, error) {
+	r := &Router{cfg: cfg, pool: pool}
+	for _, opt := range opts {
+		opt(r)
+	}
+	var balancerOpts []BalancerOption
+	if r.healthy != nil {
+		balancerOpts = append(balancerOpts, WithBalancerHealth(r.healthy))
+	}
+	if r.service != nil {
+		balancerOpts = append(balancerOpts, WithBalancerServiceHealth(r.service))
+	}
+	routes, err := compileRoutes(cfg, balancerOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.routes = routes
+	return r, nil
+}
+
+// Match returns the name of the backend the call in ctx is routed to, or an Unimplemented error if there is none.
+// For routes balancing across several backends, one of them is picked as described for Balancer.Pick.
+func (r *Router) Match(ctx context.Context, fullMethodName string) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, route := range r.routes {
+		if route.matches(fullMethodName, md) {
+			if route.balancer != nil {
+				service, _, _ := splitMethodName(fullMethodName)
+				return route.balancer.pickFor(ctx, service)
+			}
+			return r.checkHealth(route.backend, fullMethodName)
+		}
+	}
+	if r.cfg.DefaultBackend != "" {
+		return r.checkHealth(r.cfg.DefaultBackend, fullMethodName)
+	}
+	return "", status.Errorf(codes.Unimplemented, "proxy: no route for method %s", fullMethodName)
+}
+
+// ServiceBackends returns the backends that calls to methods of a service, e.g. "package.Service", can be routed to,
+// in order of name. Only the method conditions of routes are considered, and routes matching methods with a regular
+// expression are assumed to match all services.
+func (r *Router) ServiceBackends(service string) []string {
+	seen := make(map[string]bool)
+	for _, route := range r.routes {
+		if route.method != nil && route.service != nil && !route.service(service) {
+			continue
+		}
+		if route.balancer != nil {
+			for _, backend := range route.balancer.backends {
+				seen[backend] = true
+			}
+		} else {
+			seen[route.backend] = true
+		}
+	}
+	if r.cfg.DefaultBackend != "" {
+		seen[r.cfg.DefaultBackend] = true
+	}
+	backends := make([]string, 0, len(seen))
+	for backend := range seen {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+func (r *Router) checkHealth(backend, fullMethodName string) (string, error) {
+	service, _, _ := splitMethodName(fullMethodName)
+	if (r.healthy != nil && !r.healthy(backend)) || (r.service != nil && !r.service(backend, service)) {
+		return "", status.Errorf(codes.Unavailable, "proxy: backend %q is unhealthy", backend)
+	}
+	return backend, nil
+}
+
+// Director implements a StreamDirector, forwarding the inbound metadata to the backend chosen by Match.
+func (r *Router) Director(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+	backend, err := r.Match(ctx, fullMethodName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.pool == nil {
+		return nil, nil, status.Errorf(codes.Internal, "proxy: router has no backend pool")
+	}
+	if info, ok := StreamInfoFromContext(ctx); ok {
+		info.SetBackend(backend)
+	}
+	return r.pool.direct(ctx, r.cfg.Backends[backend].Target)
+}
+
+type compiledRoute struct {
+	backend   string
+	balancer  *Balancer
+	method    func(string) bool
+	service   func(string) bool
+	authority string
+	metadata  map[string]string
+}
+
+func (r *compiledRoute) matches(fullMethodName string, md metadata.MD) bool {
+	if r.method != nil && !r.method(fullMethodName) {
+		return false
+	}
+	if r.authority != "" {
+		vals := md.Get(":authority")
+		if len(vals) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(r.authority, vals[0]); !ok {
+			return false
+		}
+	}
+	for key, want := range r.metadata {
+		vals := md.Get(key)
+		if len(vals) == 0 || (want != "" && !containsString(vals, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+func compileRoutes(cfg *RouterConfig, balancerOpts ...BalancerOption) ([]*compiledRoute, error) {
+	if cfg == nil {
+		return nil, errors.New("proxy: missing router config")
+	}
+	var errs []error
+	names := make([]string, 0, len(cfg.Backends))
+	for name := range cfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cfg.Backends[name].Target == "" {
+			errs = append(errs, fmt.Errorf("backend %q: target is required", name))
+		}
+	}
+	if cfg.DefaultBackend != "" {
+		if _, ok := cfg.Backends[cfg.DefaultBackend]; !ok {
+			errs = append(errs, fmt.Errorf("default_backend: unknown backend %q", cfg.DefaultBackend))
+		}
+	}
+
+	routes := make([]*compiledRoute, 0, len(cfg.Routes))
+	for i, rc := range cfg.Routes {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		route, routeErrs := compileRoute(rc, balancerOpts)
+		for _, backend := range append([]string{rc.Backend}, rc.Backends...) {
+			if _, ok := cfg.Backends[backend]; backend != "" && !ok {
+				routeErrs = append(routeErrs, fmt.Errorf("unknown backend %q", backend))
+			}
+		}
+		for _, err := range routeErrs {
+			errs = append(errs, fmt.Errorf("route %s: %v", name, err))
+		}
+		routes = append(routes, route)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("proxy: invalid router config: %w", errors.Join(errs...))
+	}
+	return routes, nil
+}
+
+func compileRoute(rc RouteConfig, balancerOpts []BalancerOption) (*compiledRoute, []error) {
+	var errs []error
+	route := &compiledRoute{backend: rc.Backend, authority: rc.Match.Authority, metadata: rc.Match.Metadata}
+	switch {
+	case rc.Backend == "" && len(rc.Backends) == 0:
+		errs = append(errs, errors.New("backend is required"))
+	case rc.Backend != "" && len(rc.Backends) > 0:
+		errs = append(errs, errors.New("only one of backend and backends can be set"))
+	case len(rc.Backends) > 0:
+		policy := rc.Balancing
+		if policy == "" {
+			policy = RoundRobin
+		}
+		opts := append([]BalancerOption{WithHashKey(rc.HashKey)}, balancerOpts...)
+		balancer, err := NewBalancer(policy, rc.Backends, opts...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		route.balancer = balancer
+	case rc.Balancing != "":
+		errs = append(errs, errors.New("balancing needs backends to be set"))
+	}
+
+	m := rc.Match
+	set := 0
+	for _, v := range []string{m.Method, m.MethodPrefix, m.MethodGlob, m.MethodRegex} {
+		if v != "" {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		errs = append(errs, errors.New("only one of method, method_prefix, method_glob and method_regex can be set"))
+	case m.Method != "":
+		route.method = func(name string) bool { return name == m.Method }
+		route.service = func(service string) bool { return strings.HasPrefix(m.Method, "/"+service+"/") }
+	case m.MethodPrefix != "":
+		route.method = func(name string) bool { return strings.HasPrefix(name, m.MethodPrefix) }
+		route.service = func(service string) bool {
+			prefix := "/" + service + "/"
+			return strings.HasPrefix(prefix, m.MethodPrefix) || strings.HasPrefix(m.MethodPrefix, prefix)
+		}
+	case m.MethodGlob != "":
+		if _, err := path.Match(m.MethodGlob, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid method_glob %q: %v", m.MethodGlob, err))
+		}
+		route.method = func(name string) bool {
+			ok, _ := path.Match(m.MethodGlob, name)
+			return ok
+		}
+		route.service = func(service string) bool {
+			// Wildcards do not match "/", so the glob has to match the service part of the method name on its own.
+			i := strings.LastIndex(m.MethodGlob, "/")
+			ok, _ := path.Match(m.MethodGlob[:max(i, 0)], "/"+service)
+			return ok
+		}
+	case m.MethodRegex != "":
+		re, err := regexp.Compile("^(?:" + m.MethodRegex + ")$")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid method_regex %q: %v", m.MethodRegex, err))
+		} else {
+			route.method = re.MatchString
+		}
+	}
+	if m.Authority != "" {
+		if _, err := path.Match(m.Authority, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid authority %q: %v", m.Authority, err))
+		}
+	}
+	keys := make([]string, 0, len(m.Metadata))
+	for key := range m.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" || strings.ToLower(key) != key {
+			errs = append(errs, fmt.Errorf("invalid metadata key %q: keys must be lowercase", key))
+		}
+	}
+	return route, errs
+}
+
+// callService returns the service of the call in ctx, e.g. "package.Service", or an empty string if it is unknown.
+func callService(ctx context.Context) string {
+	method, _ := grpc.Method(ctx)
+	if info, ok := StreamInfoFromContext(ctx); ok {
+		method = info.FullMethod
+	}
+	service, _, _ := splitMethodName(method)
+	return service
+}
+
+func containsString(vals []string, want string) bool {
+	for _, v := range vals {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+const routerTestConfig = `
+backends:
+  users: {target: users}
+  pings: {target: pings}
+  canary: {target: canary}
+  legacy: {target: legacy}
+routes:
+  - name: canary
+    match: {metadata: {x-canary: "true"}}
+    backend: canary
+  - name: users
+    match: {method_prefix: "/example.users."}
+    backend: users
+  - name: ping-list
+    match: {method_regex: "/mwitkow\\.testproto\\.TestService/Ping(List|Stream)"}
+    backend: pings
+  - name: legacy-host
+    match: {method_glob: "/mwitkow.testproto.*/*", authority: "*.legacy.example.com"}
+    backend: legacy
+  - name: exact
+    match: {method: "/mwitkow.testproto.TestService/PingEmpty"}
+    backend: pings
+`
+
+func TestRouter_Match(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(routerTestConfig))
+	require.NoError(t, err)
+	router, err := proxy.NewRouter(cfg, nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		method string
+		md     metadata.MD
+		want   string
+	}{
+		{method: "/example.users.v1.Users/Get", want: "users"},
+		{method: "/example.users.v1.Users/Get", md: metadata.Pairs("x-canary", "true"), want: "canary"},
+		{method: "/example.users.v1.Users/Get", md: metadata.Pairs("x-canary", "false"), want: "users"},
+		{method: "/mwitkow.testproto.TestService/PingList", want: "pings"},
+		{method: "/mwitkow.testproto.TestService/PingStream", want: "pings"},
+		{method: "/mwitkow.testproto.TestService/PingEmpty", want: "pings"},
+		{method: "/mwitkow.testproto.TestService/Ping", md: metadata.Pairs(":authority", "eu.legacy.example.com"), want: "legacy"},
+		{method: "/mwitkow.testproto.TestService/Ping", md: metadata.Pairs(":authority", "api.example.com")},
+		{method: "/mwitkow.testproto.TestService/PingListButLonger"},
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+		got, err := router.Match(ctx, tc.method)
+		if tc.want == "" {
+			assert.Equal(t, codes.Unimplemented, status.Code(err), "%s %v", tc.method, tc.md)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got, "%s %v", tc.method, tc.md)
+	}
+
+	cfg.DefaultBackend = "legacy"
+	router, err = proxy.NewRouter(cfg, nil)
+	require.NoError(t, err)
+	got, err := router.Match(context.Background(), "/unknown.Service/Method")
+	require.NoError(t, err)
+	assert.Equal(t, "legacy", got)
+}
+
+func TestRouterConfig_Validate(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(`{
+		"backends": {"a": {"target": "a:443"}, "b": {}},
+		"routes": [
+			{"match": {"method": "/a.A/Get", "method_prefix": "/a."}, "backend": "a"},
+			{"name": "bad-regex", "match": {"method_regex": "(unclosed"}, "backend": "a"},
+			{"name": "bad-glob", "match": {"method_glob": "[", "authority": "["}, "backend": "c"},
+			{"name": "bad-md", "match": {"metadata": {"X-Tenant": "acme"}}}
+		],
+		"default_backend": "d"
+	}`))
+	require.NoError(t, err, "JSON configs must be accepted")
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	for _, want := range []string{
+		`backend "b": target is required`,
+		`default_backend: unknown backend "d"`,
+		`route #0: only one of method`,
+		`route bad-regex: invalid method_regex`,
+		`route bad-glob: invalid method_glob`,
+		`route bad-glob: invalid authority`,
+		`route bad-glob: unknown backend "c"`,
+		`route bad-md: backend is required`,
+		`route bad-md: invalid metadata key "X-Tenant"`,
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+	_, err = proxy.NewRouter(cfg, nil)
+	assert.Error(t, err, "invalid configs must be rejected")
+
+	_, err = proxy.ParseRouterConfig([]byte("routes:\n  - matches: {}\n"))
+	assert.Error(t, err, "unknown fields must be rejected")
+}
+
+func TestRouter_Director(t *testing.T) {
+	pool := proxy.NewBackendPool(proxy.WithPoolDialOptions(bufconnBackends(t, "pings")...))
+	defer pool.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(routerTestConfig), 0o644))
+	cfg, err := proxy.LoadRouterConfig(path)
+	require.NoError(t, err)
+	cfg.DefaultBackend = "pings"
+	router, err := proxy.NewRouter(cfg, pool)
+	require.NoError(t, err)
+
+	testservice.TestTestServiceServerImpl(t, directedTestClient(t, router.Director))
+}
+
+func TestRouter_DirectorWithoutPool(t *testing.T) {
+	cfg, err := proxy.ParseRouterConfig([]byte(routerTestConfig))
+	require.NoError(t, err)
+	cfg.DefaultBackend = "pings"
+	router, err := proxy.NewRouter(cfg, nil)
+	require.NoError(t, err)
+
+	_, err = directedTestClient(t, router.Director).Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// SplitGroup is a group of backends receiving a share of the calls split by a SplitDirector.
+type SplitGroup struct {
+	// Name identifies the group, e.g. "stable" or "canary".
+	Name string
+	// Weight is the share of calls sent to the group, relative to the weights of the other groups.
+	Weight int
+	// Director forwards the calls sent to the group, e.g. the BalancingDirector of its backends.
+	Director StreamDirector
+}
+
+// SplitDirector is a StreamDirector splitting calls between groups of backends by weight, e.g. to send 5% of the
+// traffic to a canary release. Calls carrying an override header are sent to the group it names, regardless of the
+// weights. The group of each call is recorded in its StreamInfo, see StreamInfo.Group.
+//
+// Weights can be changed while the director is in use with SetWeights.
+type SplitDirector struct {
+	groups    []SplitGroup
+	overrides []splitOverride
+	weights   atomic.Pointer[splitWeights]
+}
+
+type splitOverride struct {
+	key, value string
+	group      int
+}
+
+type splitWeights struct {
+	// cumulative holds the running sums of the weights of the groups.
+	cumulative []int
+}
+
+// SplitOption configures a SplitDirector.
+type SplitOption func(*SplitDirector) error
+
+// WithSplitOverride sends calls whose metadata key has the given value, compared case-insensitively, to the named
+// group. An empty value matches any value. Overrides are evaluated in order and the first matching one applies.
+func WithSplitOverride(key, value, group string) SplitOption {
+	return func(d *SplitDirector) error {
+		i := d.groupIndex(group)
+		if i < 0 {
+			return fmt.Errorf("proxy: override %s=%q refers to unknown group %q", key, value, group)
+		}
+		d.overrides = append(d.overrides, splitOverride{key: strings.ToLower(key), value: value, group: i})
+		return nil
+	}
+}
+
+// NewSplitDirector creates a SplitDirector splitting calls between groups.
+func NewSplitDirector(groups []SplitGroup, opts ...SplitOption) (*SplitDirector, error) {
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("proxy: traffic split needs at least one group")
+	}
+	d := &SplitDirector{}
+	weights := make(map[string]int)
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("proxy: traffic split group without a name")
+		}
+		if _, ok := weights[g.Name]; ok {
+			return nil, fmt.Errorf("proxy: duplicate traffic split group %q", g.Name)
+		}
+		if g.Director == nil {
+			return nil, fmt.Errorf("proxy: traffic split group %q has no director", g.Name)
+		}
+		weights[g.Name] = g.Weight
+		d.groups = append(d.groups, g)
+	}
+	for _, opt := range opts {
+		if err := opt(d); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// SetWeights changes the weights of the groups. Groups missing from weights keep their current weight. Weights must
+// not be negative, and at least one of them must be positive.
+func (d *SplitDirector) SetWeights(weights map[string]int) error {
+	current := d.Weights()
+	for name, w := range weights {
+		if d.groupIndex(name) < 0 {
+			return fmt.Errorf("proxy: unknown traffic split group %q", name)
+		}
+		if w < 0 {
+			return fmt.Errorf("proxy: negative weight %d for traffic split group %q", w, name)
+		}
+		current[name] = w
+	}
+	sw := &splitWeights{}
+	total := 0
+	for _, g := range d.groups {
+		total += current[g.Name]
+		sw.cumulative = append(sw.cumulative, total)
+	}
+	if total == 0 {
+		return fmt.Errorf("proxy: all traffic split weights are zero")
+	}
+	d.weights.Store(sw)
+	return nil
+}
+
+// Weights returns the current weights of the groups, by name.
+func (d *SplitDirector) Weights() map[string]int {
+	weights := make(map[string]int)
+	sw := d.weights.Load()
+	for i, g := range d.groups {
+		switch {
+		case sw == nil:
+			weights[g.Name] = g.Weight
+		case i == 0:
+			weights[g.Name] = sw.cumulative[0]
+		default:
+			weights[g.Name] = sw.cumulative[i] - sw.cumulative[i-1]
+		}
+	}
+	return weights
+}
+
+func (d *SplitDirector) groupIndex(name string) int {
+	for i, g := range d.groups {
+		if g.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick returns the index of the group the call on ctx is sent to.
+func (d *SplitDirector) pick(ctx context.Context) int {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, o := range d.overrides {
+		for _, v := range md.Get(o.key) {
+			if o.value == "" || strings.EqualFold(v, o.value) {
+				return o.group
+			}
+		}
+	}
+	sw := d.weights.Load()
+	n := rand.Intn(sw.cumulative[len(sw.cumulative)-1])
+	for i, c := range sw.cumulative {
+		if n < c {
+			return i
+		}
+	}
+	return len(sw.cumulative) - 1
+}
+
+// Director implements StreamDirector, forwarding the call with the director of the group it is sent to.
+func (d *SplitDirector) Director(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+	g := d.groups[d.pick(ctx)]
+	if info, ok := StreamInfoFromContext(ctx); ok {
+		info.SetGroup(g.Name)
+	}
+	return g.Director(ctx, fullMethodName)
+}
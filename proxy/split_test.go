@@ -0,0 +1,108 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+// countingGroups returns SplitGroups with the given weights, forwarding calls to cc and counting them per group.
+func countingGroups(t *testing.T, cc grpc.ClientConnInterface, counts map[string]int, weights map[string]int) []proxy.SplitGroup {
+	var groups []proxy.SplitGroup
+	for _, name := range []string{"stable", "canary"} {
+		name := name
+		director := proxy.DefaultDirector(cc)
+		groups = append(groups, proxy.SplitGroup{
+			Name:   name,
+			Weight: weights[name],
+			Director: func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+				if info, ok := proxy.StreamInfoFromContext(ctx); ok {
+					assert.Equal(t, name, info.Group())
+				}
+				counts[name]++
+				return director(ctx, fullMethodName)
+			},
+		})
+	}
+	return groups
+}
+
+func TestSplitDirector_Weights(t *testing.T) {
+	counts := make(map[string]int)
+	d, err := proxy.NewSplitDirector(countingGroups(t, nil, counts, map[string]int{"stable": 95, "canary": 5}))
+	require.NoError(t, err)
+
+	for i := 0; i < 2000; i++ {
+		_, _, err := d.Director(context.Background(), "/test.Service/Method")
+		require.NoError(t, err)
+	}
+	assert.InDelta(t, 1900, counts["stable"], 100)
+	assert.InDelta(t, 100, counts["canary"], 100)
+
+	require.NoError(t, d.SetWeights(map[string]int{"stable": 0}))
+	assert.Equal(t, map[string]int{"stable": 0, "canary": 5}, d.Weights())
+	for i := 0; i < 100; i++ {
+		_, _, err := d.Director(context.Background(), "/test.Service/Method")
+		require.NoError(t, err)
+	}
+	assert.InDelta(t, 200, counts["canary"], 100)
+	assert.InDelta(t, 1900, counts["stable"], 100)
+
+	assert.Error(t, d.SetWeights(map[string]int{"canary": 0}))
+	assert.Error(t, d.SetWeights(map[string]int{"canary": -1}))
+	assert.Error(t, d.SetWeights(map[string]int{"other": 1}))
+	assert.Equal(t, map[string]int{"stable": 0, "canary": 5}, d.Weights())
+}
+
+func TestSplitDirector_Override(t *testing.T) {
+	cc, err := backendDialer(t)
+	require.NoError(t, err)
+	counts := make(map[string]int)
+	d, err := proxy.NewSplitDirector(countingGroups(t, cc, counts, map[string]int{"stable": 1, "canary": 0}),
+		proxy.WithSplitOverride("x-canary", "true", "canary"))
+	require.NoError(t, err)
+	client := directedTestClient(t, d.Director)
+
+	_, err = client.Ping(context.Background(), &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-canary", "TRUE")
+	_, err = client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-canary", "false")
+	_, err = client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"stable": 2, "canary": 1}, counts)
+}
+
+func TestNewSplitDirector_Invalid(t *testing.T) {
+	director := proxy.DefaultDirector(nil)
+	for _, tc := range []struct {
+		name   string
+		groups []proxy.SplitGroup
+		opts   []proxy.SplitOption
+	}{
+		{name: "no groups"},
+		{name: "no name", groups: []proxy.SplitGroup{{Weight: 1, Director: director}}},
+		{name: "no director", groups: []proxy.SplitGroup{{Name: "a", Weight: 1}}},
+		{name: "duplicate", groups: []proxy.SplitGroup{{Name: "a", Weight: 1, Director: director}, {Name: "a", Weight: 1, Director: director}}},
+		{name: "zero weights", groups: []proxy.SplitGroup{{Name: "a", Director: director}}},
+		{
+			name:   "unknown override group",
+			groups: []proxy.SplitGroup{{Name: "a", Weight: 1, Director: director}},
+			opts:   []proxy.SplitOption{proxy.WithSplitOverride("x-canary", "true", "b")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := proxy.NewSplitDirector(tc.groups, tc.opts...)
+			assert.Error(t, err)
+		})
+	}
+}
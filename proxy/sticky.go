@@ -0,0 +1,182 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// HashKeySource extracts the key sticky sessions are hashed on from the context of a call. It returns an empty
+// string if the call carries no key.
+type HashKeySource func(ctx context.Context) string
+
+// HashByMetadata uses the first value of a metadata key as the hash key.
+func HashByMetadata(key string) HashKeySource {
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if vals := md.Get(key); len(vals) > 0 {
+			return vals[0]
+		}
+		return ""
+	}
+}
+
+// HashByPeerAddress uses the IP address of the inbound peer as the hash key.
+func HashByPeerAddress() HashKeySource {
+	return func(ctx context.Context) string {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return ""
+		}
+		if ip, ok := addrIP(p.Addr); ok {
+			return ip.String()
+		}
+		return p.Addr.String()
+	}
+}
+
+// HashByCookie uses the value of the named cookie, sent in the `cookie` metadata key as with HTTP, as the hash key.
+func HashByCookie(name string) HashKeySource {
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		req := &http.Request{Header: http.Header{"Cookie": md.Get("cookie")}}
+		if c, err := req.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// StickyDirector is a StreamDirector that sends all calls with the same hash key to the same backend, using a
+// consistent hashing ring. Adding or removing a backend only moves the keys of that backend.
+//
+// When the backend owning a key is unhealthy, calls go to the next healthy backend on the ring, and return once it is
+// healthy again. Retries of a call, see WithRetries, go to the next backend on the ring as well. Calls without a hash
+// key are balanced round-robin across healthy backends.
+type StickyDirector struct {
+	key     HashKeySource
+	healthy func(backend string) bool
+	service func(backend, service string) bool
+	state   atomic.Pointer[stickyState]
+	next    atomic.Uint64
+}
+
+type stickyState struct {
+	names []string
+	conns map[string]grpc.ClientConnInterface
+	ring  *hashRing
+}
+
+// StickyOption configures a StickyDirector.
+type StickyOption func(*StickyDirector)
+
+// WithStickyHealth sets the function reporting whether a backend is healthy. By default all backends are.
+func WithStickyHealth(healthy func(backend string) bool) StickyOption {
+	return func(s *StickyDirector) {
+		s.healthy = healthy
+	}
+}
+
+// WithStickyServiceHealth sets the function reporting whether a backend is healthy for the service of a call, such as
+// HealthChecker.ServiceHealthy. By default all backends are.
+func WithStickyServiceHealth(healthy func(backend, service string) bool) StickyOption {
+	return func(s *StickyDirector) {
+		s.service = healthy
+	}
+}
+
+// NewStickyDirector creates a StickyDirector hashing calls on key across the named backend connections.
+func NewStickyDirector(key HashKeySource, backends map[string]grpc.ClientConnInterface, opts ...StickyOption) *StickyDirector {
+	s := &StickyDirector{key: key, healthy: func(string) bool { return true }, service: func(string, string) bool { return true }}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.SetBackends(backends)
+	return s
+}
+
+// SetBackends replaces the set of backends. Keys owned by backends present before and after keep their assignment.
+func (s *StickyDirector) SetBackends(backends map[string]grpc.ClientConnInterface) {
+	st := &stickyState{conns: make(map[string]grpc.ClientConnInterface, len(backends))}
+	for name, cc := range backends {
+		st.names = append(st.names, name)
+		st.conns[name] = cc
+	}
+	sort.Strings(st.names)
+	st.ring = newHashRing(st.names)
+	s.state.Store(st)
+}
+
+// Pick returns the backend for the call in ctx and records it in the StreamInfo of the call.
+func (s *StickyDirector) Pick(ctx context.Context) (string, error) {
+	return s.pick(ctx, s.state.Load())
+}
+
+func (s *StickyDirector) pick(ctx context.Context, st *stickyState) (string, error) {
+	if len(st.names) == 0 {
+		return "", status.Errorf(codes.Unavailable, "proxy: no backends configured")
+	}
+	service := callService(ctx)
+	healthy := func(name string) bool { return s.healthy(name) && s.service(name, service) }
+	picked := -1
+	if info, ok := StreamInfoFromContext(ctx); ok && info.Attempt() > 0 {
+		previous := info.PreviousBackends()
+		picked = s.pickIndex(ctx, st, func(name string) bool { return healthy(name) && !containsString(previous, name) })
+	}
+	if picked < 0 {
+		picked = s.pickIndex(ctx, st, healthy)
+	}
+	if picked < 0 {
+		return "", status.Errorf(codes.Unavailable, "proxy: no healthy backend available")
+	}
+	if info, ok := StreamInfoFromContext(ctx); ok {
+		info.SetBackend(st.names[picked])
+	}
+	return st.names[picked], nil
+}
+
+// pickIndex returns the index of the backend for the call in ctx among the ones usable reports true for, or -1 if
+// there is none.
+func (s *StickyDirector) pickIndex(ctx context.Context, st *stickyState, usable func(name string) bool) int {
+	picked := -1
+	if key := s.key(ctx); key != "" {
+		st.ring.walk(key, func(owner int) bool {
+			if usable(st.names[owner]) {
+				picked = owner
+				return false
+			}
+			return true
+		})
+		return picked
+	}
+	n := len(st.names)
+	start := int(s.next.Add(1) % uint64(n))
+	for j := 0; j < n; j++ {
+		if i := (start + j) % n; usable(st.names[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Director implements a StreamDirector, forwarding the inbound metadata to the backend chosen by Pick.
+func (s *StickyDirector) Director(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+	st := s.state.Load()
+	backend, err := s.pick(ctx, st)
+	if err != nil {
+		return nil, nil, err
+	}
+	cc := st.conns[backend]
+	md, _ := metadata.FromIncomingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, md.Copy()), cc, nil
+}
@@ -0,0 +1,146 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+)
+
+type namedConn struct {
+	grpc.ClientConnInterface
+	name string
+}
+
+func namedConns(names ...string) map[string]grpc.ClientConnInterface {
+	conns := make(map[string]grpc.ClientConnInterface)
+	for _, name := range names {
+		conns[name] = &namedConn{name: name}
+	}
+	return conns
+}
+
+func TestHashKeySources(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-session", "s1",
+		"cookie", "theme=dark; session=abc",
+		"cookie", "other=1",
+	))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 4321}})
+
+	assert.Equal(t, "s1", proxy.HashByMetadata("x-session")(ctx))
+	assert.Equal(t, "", proxy.HashByMetadata("x-missing")(ctx))
+	assert.Equal(t, "10.0.0.7", proxy.HashByPeerAddress()(ctx), "the port must not be part of the key")
+	assert.Equal(t, "abc", proxy.HashByCookie("session")(ctx))
+	assert.Equal(t, "1", proxy.HashByCookie("other")(ctx))
+	assert.Equal(t, "", proxy.HashByCookie("missing")(ctx))
+	assert.Equal(t, "", proxy.HashByPeerAddress()(context.Background()))
+}
+
+func TestStickyDirector_Stable(t *testing.T) {
+	s := proxy.NewStickyDirector(proxy.HashByMetadata("x-session"), namedConns("a", "b", "c", "d"))
+	pick := func(session string) string {
+		backend, err := s.Pick(metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-session", session)))
+		require.NoError(t, err)
+		return backend
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		before[session] = pick(session)
+		assert.Equal(t, before[session], pick(session))
+	}
+
+	s.SetBackends(namedConns("a", "b", "c", "e"))
+	moved := 0
+	for session, backend := range before {
+		now := pick(session)
+		if now == backend {
+			continue
+		}
+		moved++
+		if backend != "d" {
+			assert.Equal(t, "e", now, "keys may only move from the removed or to the added backend")
+		}
+	}
+	assert.Less(t, moved, 250, "only a fraction of the keys may move")
+}
+
+func TestStickyDirector_UnhealthyFallback(t *testing.T) {
+	var mu sync.Mutex
+	down := make(map[string]bool)
+	healthy := func(backend string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !down[backend]
+	}
+	setDown := func(backend string, v bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		down[backend] = v
+	}
+	s := proxy.NewStickyDirector(proxy.HashByMetadata("x-session"), namedConns("a", "b", "c"), proxy.WithStickyHealth(healthy))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-session", "user-42"))
+
+	owner, err := s.Pick(ctx)
+	require.NoError(t, err)
+
+	setDown(owner, true)
+	fallback, err := s.Pick(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, owner, fallback)
+	again, err := s.Pick(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, fallback, again, "the fallback must be stable too")
+
+	setDown(owner, false)
+	back, err := s.Pick(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, owner, back, "calls must return to the owner once healthy")
+
+	for _, name := range []string{"a", "b", "c"} {
+		setDown(name, true)
+	}
+	_, err = s.Pick(ctx)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = s.Pick(context.Background())
+	assert.Equal(t, codes.Unavailable, status.Code(err), "calls without a key must fail too")
+}
+
+func TestStickyDirector_Director(t *testing.T) {
+	s := proxy.NewStickyDirector(proxy.HashByCookie("session"), namedConns("a", "b"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("cookie", "session=xyz", "x-other", "1"))
+
+	outCtx, cc, err := s.Director(ctx, "/some.Service/Method")
+	require.NoError(t, err)
+	backend, err := s.Pick(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, backend, cc.(*namedConn).name)
+	md, _ := metadata.FromOutgoingContext(outCtx)
+	assert.Equal(t, []string{"1"}, md.Get("x-other"), "inbound metadata must be forwarded")
+
+	// Calls without a key are spread round-robin.
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		_, cc, err := s.Director(context.Background(), "/some.Service/Method")
+		require.NoError(t, err)
+		seen[cc.(*namedConn).name] = true
+	}
+	assert.Len(t, seen, 2)
+
+	s.SetBackends(nil)
+	_, _, err = s.Director(ctx, "/some.Service/Method")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamInfo describes a call handled by the proxy. The handler makes it available to the StreamDirector and to
+// hooks through the context of the call, see StreamInfoFromContext.
+type StreamInfo struct {
+	// FullMethod is the full RPC method string, i.e., /package.service/method.
+	FullMethod string
+	// StartTime is the time the proxy started handling the call.
+	StartTime time.Time
+
+	// messages and bytes are indexed by FrameDirection.
+	messages      [2]atomic.Int64
+	bytes         [2]atomic.Int64
+	firstResponse atomic.Int64
+
+	mu        sync.Mutex
+	backend   string
+	group     string
+	attempt   int
+	previous  []string
+	done      bool
+	err       error
+	doneFuncs []func(err error)
+	// attemptFuncs are called once the attempt started after their registration is done.
+	attemptFuncs []func(err error)
+}
+
+type streamInfoKey struct{}
+
+// StreamInfoFromContext returns the StreamInfo of the proxied call ctx belongs to.
+func StreamInfoFromContext(ctx context.Context) (*StreamInfo, bool) {
+	info, ok := ctx.Value(streamInfoKey{}).(*StreamInfo)
+	return info, ok
+}
+
+func newStreamInfo(ctx context.Context, fullMethodName string) (context.Context, *StreamInfo) {
+	info := &StreamInfo{FullMethod: fullMethodName, StartTime: time.Now()}
+	return context.WithValue(ctx, streamInfoKey{}, info), info
+}
+
+// SetBackend records the name of the backend the call is forwarded to. Directors picking between named backends
+// should set it, so that the outcome of the call can be attributed to the backend.
+func (i *StreamInfo) SetBackend(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.backend = name
+}
+
+// Backend returns the name of the backend the call is forwarded to, or an empty string if it is not known.
+func (i *StreamInfo) Backend() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.backend
+}
+
+// SetGroup records the name of the group of backends the call is forwarded to, such as the canary group picked by a
+// SplitDirector, so that logs and metrics can be labelled with it.
+func (i *StreamInfo) SetGroup(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.group = name
+}
+
+// Group returns the name of the group of backends the call is forwarded to, or an empty string if it is not known.
+func (i *StreamInfo) Group() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.group
+}
+
+// Attempt returns the number of the current attempt at forwarding the call, 0 for the first one. Calls are only
+// attempted more than once with WithRetries or WithHedging.
+func (i *StreamInfo) Attempt() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.attempt
+}
+
+// PreviousBackends returns the backends of the previous attempts at forwarding the call, in order. Directors should
+// prefer other backends for retries and hedged attempts.
+func (i *StreamInfo) PreviousBackends() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]string(nil), i.previous...)
+}
+
+// nextAttempt records the end of the current attempt, to be followed by another one.
+func (i *StreamInfo) nextAttempt() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.previous = append(i.previous, i.backend)
+	i.backend = ""
+	i.attempt++
+}
+
+// Messages returns the number of messages forwarded in direction d so far, and their total size in bytes. Messages of
+// the client replayed to several backends are counted every time they are sent.
+func (i *StreamInfo) Messages(d FrameDirection) (count, bytes int64) {
+	return i.messages[d].Load(), i.bytes[d].Load()
+}
+
+// FirstResponse returns the time the first message of the backend was received, or the zero time if none was.
+func (i *StreamInfo) FirstResponse() time.Time {
+	if t := i.firstResponse.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (i *StreamInfo) countMessage(d FrameDirection, size int) {
+	if i == nil {
+		return
+	}
+	i.messages[d].Add(1)
+	i.bytes[d].Add(int64(size))
+}
+
+func (i *StreamInfo) markFirstResponse(t time.Time) {
+	if i == nil || t.IsZero() {
+		return
+	}
+	i.firstResponse.CompareAndSwap(0, t.UnixNano())
+}
+
+// OnDone registers f to be called once the proxy finished handling the call, with the error returned to the client.
+// If the call is already done, f is called immediately.
+func (i *StreamInfo) OnDone(f func(err error)) {
+	i.mu.Lock()
+	if !i.done {
+		i.doneFuncs = append(i.doneFuncs, f)
+		i.mu.Unlock()
+		return
+	}
+	err := i.err
+	i.mu.Unlock()
+	f(err)
+}
+
+// onAttemptDone registers f to be called once the attempt at forwarding the call that is being started is done, such
+// as the attempt a StreamDirector picks a backend for. If no attempt is started, f is called once the call is done.
+func (i *StreamInfo) onAttemptDone(f func(err error)) {
+	i.mu.Lock()
+	if !i.done {
+		i.attemptFuncs = append(i.attemptFuncs, f)
+		i.mu.Unlock()
+		return
+	}
+	err := i.err
+	i.mu.Unlock()
+	f(err)
+}
+
+// takeAttemptFuncs returns the callbacks registered with onAttemptDone for the attempt being started, which takes
+// over calling them.
+func (i *StreamInfo) takeAttemptFuncs() []func(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	funcs := i.attemptFuncs
+	i.attemptFuncs = nil
+	return funcs
+}
+
+// finish marks the call as done, running the callbacks registered with OnDone in reverse order, after the ones of
+// onAttemptDone no attempt took over.
+func (i *StreamInfo) finish(err error) {
+	i.mu.Lock()
+	i.done = true
+	i.err = err
+	doneFuncs := append(i.doneFuncs, i.attemptFuncs...)
+	i.doneFuncs, i.attemptFuncs = nil, nil
+	i.mu.Unlock()
+	for j := len(doneFuncs) - 1; j >= 0; j-- {
+		doneFuncs[j](err)
+	}
+}
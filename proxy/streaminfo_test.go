@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStreamInfo_Lifecycle(t *testing.T) {
+	ctx, info := newStreamInfo(context.Background(), "/mwitkow.testproto.TestService/Ping")
+	fromCtx, ok := StreamInfoFromContext(ctx)
+	require.True(t, ok)
+	assert.Same(t, info, fromCtx)
+	_, ok = StreamInfoFromContext(context.Background())
+	assert.False(t, ok)
+
+	info.SetBackend("a")
+	assert.Equal(t, "a", info.Backend())
+
+	var order []string
+	info.OnDone(func(err error) { order = append(order, "first") })
+	info.OnDone(func(err error) { order = append(order, "second") })
+	finalErr := status.Error(codes.Unavailable, "backend gone")
+	info.finish(finalErr)
+	assert.Equal(t, []string{"second", "first"}, order, "callbacks must run in reverse order")
+
+	var late error
+	info.OnDone(func(err error) { late = err })
+	assert.Equal(t, finalErr, late, "callbacks registered after the call is done must run immediately")
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TimeoutRule limits the deadline of forwarded calls to the methods it matches.
+//
+// The deadline of the inbound call, as set by the client through `grpc-timeout`, is propagated to the backend call.
+// A TimeoutRule adjusts it before the backend stream is opened.
+type TimeoutRule struct {
+	// Method is a pattern matched against the full method name, e.g. "/package.service/method". It uses path.Match
+	// syntax, so "/package.service/*" matches all methods of a service. An empty pattern or "*" matches all methods.
+	Method string
+	// Default is the timeout applied to calls without a deadline. Zero leaves such calls without one.
+	Default time.Duration
+	// Max caps the timeout of calls, including ones without a deadline. Zero means no cap.
+	Max time.Duration
+	// Overhead is subtracted from the inbound deadline, reserving time for the proxy to relay the backend's response
+	// before the client gives up.
+	Overhead time.Duration
+	// MinBudget is the minimum time left for the call to the backend. Calls with less time left fail with
+	// DeadlineExceeded without reaching the backend.
+	MinBudget time.Duration
+}
+
+// WithTimeouts sets TimeoutRules for the deadlines of forwarded calls. Rules are evaluated in order and only the
+// first rule matching a method is applied.
+func WithTimeouts(rules ...TimeoutRule) HandlerOption {
+	return func(o *handlerOptions) {
+		o.timeouts = append(o.timeouts, rules...)
+	}
+}
+
+// applyTimeout adjusts the deadline of the outgoing ctx according to the first TimeoutRule matching the method.
+func (o *handlerOptions) applyTimeout(ctx context.Context, fullMethodName string) (context.Context, context.CancelFunc, error) {
+	for _, rule := range o.timeouts {
+		if matchMethod(rule.Method, fullMethodName) {
+			return rule.apply(ctx)
+		}
+	}
+	return ctx, func() {}, nil
+}
+
+func (r TimeoutRule) apply(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	var timeout time.Duration
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		timeout = time.Until(deadline) - r.Overhead
+	} else if r.Default > 0 {
+		timeout, hasDeadline = r.Default, true
+	}
+	if r.Max > 0 && (!hasDeadline || timeout > r.Max) {
+		timeout, hasDeadline = r.Max, true
+	}
+	if !hasDeadline {
+		return ctx, func() {}, nil
+	}
+	if timeout <= 0 || timeout < r.MinBudget {
+		return nil, nil, status.Errorf(codes.DeadlineExceeded, "proxy: not enough time left to forward the call (%v)", timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// matchMethod returns whether fullMethodName matches pattern, as described for TimeoutRule.Method.
+func matchMethod(pattern, fullMethodName string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	ok, _ := path.Match(pattern, fullMethodName)
+	return ok
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTimeoutRule_Apply(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		rule        TimeoutRule
+		inbound     time.Duration // zero means no inbound deadline
+		want        time.Duration // zero means no outbound deadline
+		wantErrCode codes.Code
+	}{
+		{name: "no deadline, no default", rule: TimeoutRule{}},
+		{name: "default applies without deadline", rule: TimeoutRule{Default: time.Second}, want: time.Second},
+		{name: "default ignored with deadline", rule: TimeoutRule{Default: time.Second}, inbound: time.Minute, want: time.Minute},
+		{name: "max caps missing deadline", rule: TimeoutRule{Max: 5 * time.Second}, want: 5 * time.Second},
+		{name: "max caps default", rule: TimeoutRule{Default: time.Minute, Max: 5 * time.Second}, want: 5 * time.Second},
+		{name: "max caps long deadline", rule: TimeoutRule{Max: 5 * time.Second}, inbound: time.Minute, want: 5 * time.Second},
+		{name: "overhead is subtracted", rule: TimeoutRule{Overhead: time.Second}, inbound: time.Minute, want: 59 * time.Second},
+		{name: "budget exhausted by overhead", rule: TimeoutRule{Overhead: time.Second}, inbound: 500 * time.Millisecond, wantErrCode: codes.DeadlineExceeded},
+		{name: "min budget not met", rule: TimeoutRule{MinBudget: time.Second}, inbound: 500 * time.Millisecond, wantErrCode: codes.DeadlineExceeded},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.inbound > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.inbound)
+				defer cancel()
+			}
+			out, cancel, err := tc.rule.apply(ctx)
+			if tc.wantErrCode != codes.OK {
+				assert.Equal(t, tc.wantErrCode, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			defer cancel()
+			deadline, ok := out.Deadline()
+			if tc.want == 0 {
+				assert.False(t, ok, "no deadline expected")
+				return
+			}
+			require.True(t, ok, "deadline expected")
+			assert.InDelta(t, tc.want, time.Until(deadline), float64(100*time.Millisecond))
+		})
+	}
+}
+
+func TestHandlerOptions_ApplyTimeoutPicksFirstMatch(t *testing.T) {
+	o := evaluateOptions([]HandlerOption{WithTimeouts(
+		TimeoutRule{Method: "/mwitkow.testproto.TestService/PingStream"},
+		TimeoutRule{Method: "/mwitkow.testproto.TestService/*", Max: time.Second},
+		TimeoutRule{Max: time.Minute},
+	)})
+	for method, want := range map[string]time.Duration{
+		"/mwitkow.testproto.TestService/PingStream": 0,
+		"/mwitkow.testproto.TestService/Ping":       time.Second,
+		"/other.Service/Ping":                       time.Minute,
+	} {
+		ctx, cancel, err := o.applyTimeout(context.Background(), method)
+		require.NoError(t, err)
+		deadline, ok := ctx.Deadline()
+		if want == 0 {
+			assert.False(t, ok, method)
+		} else {
+			assert.InDelta(t, want, time.Until(deadline), float64(100*time.Millisecond), method)
+		}
+		cancel()
+	}
+}
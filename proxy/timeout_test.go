@@ -0,0 +1,33 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+func TestHandler_TimeoutsEndInDeadlineExceeded(t *testing.T) {
+	client := proxyTestClient(t, nil, proxy.WithTimeouts(proxy.TimeoutRule{
+		Max:       50 * time.Millisecond,
+		MinBudget: 20 * time.Millisecond,
+	}))
+
+	// The backend waits for the client to close the stream, which never happens.
+	stream, err := client.PingStream(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Ping(ctx, &testservice.PingRequest{Value: "hello"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
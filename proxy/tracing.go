@@ -0,0 +1,191 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "github.com/mwitkow/grpc-proxy/proxy"
+
+// Tracing traces the calls handled by the proxy with OpenTelemetry. The trace context of the client is extracted
+// from the inbound metadata, and every call gets a server span, with a child span for the StreamDirector and one for
+// each stream opened to a backend. The context of the backend span is injected into the outbound metadata, replacing
+// the one of the client.
+//
+// Spans only rely on what the proxy knows without message types: the method, the backend and its target, the final
+// status, and the number and size of the messages forwarded in each direction.
+type Tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+type tracingOptions struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+}
+
+// TracingOption configures Tracing.
+type TracingOption func(*tracingOptions)
+
+// WithTracerProvider sets the provider of the tracer spans are created with, the global one by default.
+func WithTracerProvider(provider trace.TracerProvider) TracingOption {
+	return func(o *tracingOptions) {
+		o.provider = provider
+	}
+}
+
+// WithTracingPropagator sets the propagator the trace context is extracted and injected with. By default, W3C trace
+// context, baggage and B3 headers are propagated. B3 is extracted from both its single and multiple header forms, and
+// injected in the single header form.
+func WithTracingPropagator(propagator propagation.TextMapPropagator) TracingOption {
+	return func(o *tracingOptions) {
+		o.propagator = propagator
+	}
+}
+
+// NewTracing creates Tracing.
+func NewTracing(opts ...TracingOption) *Tracing {
+	o := &tracingOptions{
+		propagator: propagation.NewCompositeTextMapPropagator(
+			b3.New(),
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.provider == nil {
+		o.provider = otel.GetTracerProvider()
+	}
+	return &Tracing{tracer: o.provider.Tracer(tracerName), propagator: o.propagator}
+}
+
+// WithTracing makes the handler trace the calls it handles with t.
+func WithTracing(t *Tracing) HandlerOption {
+	return func(o *handlerOptions) {
+		o.tracing = t
+	}
+}
+
+// metadataCarrier adapts metadata.MD to propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if vals := metadata.MD(c).Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// rpcAttributes returns the attributes describing the method of a call.
+func rpcAttributes(fullMethodName string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("rpc.system", "grpc")}
+	if service, method, ok := strings.Cut(strings.TrimPrefix(fullMethodName, "/"), "/"); ok {
+		attrs = append(attrs, attribute.String("rpc.service", service), attribute.String("rpc.method", method))
+	}
+	return attrs
+}
+
+// endSpan ends span with the outcome of a call.
+func endSpan(span trace.Span, err error) {
+	st, _ := status.FromError(err)
+	span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(st.Code())))
+	if err != nil {
+		span.SetStatus(otelcodes.Error, st.Message())
+	}
+	span.End()
+}
+
+// startCall starts the server span of the call described by info, which ends with the call.
+func (t *Tracing) startCall(ctx context.Context, info *StreamInfo) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = t.propagator.Extract(ctx, metadataCarrier(md))
+	ctx, span := t.tracer.Start(ctx, strings.TrimPrefix(info.FullMethod, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(info.StartTime),
+		trace.WithAttributes(rpcAttributes(info.FullMethod)...))
+	if id, ok := RequestIDFromContext(ctx); ok {
+		span.SetAttributes(attribute.String("proxy.request_id", id))
+	}
+	info.OnDone(func(err error) {
+		var attrs []attribute.KeyValue
+		if backend := info.Backend(); backend != "" {
+			attrs = append(attrs, attribute.String("proxy.backend", backend))
+		}
+		if group := info.Group(); group != "" {
+			attrs = append(attrs, attribute.String("proxy.group", group))
+		}
+		for _, d := range []FrameDirection{ClientToBackend, BackendToClient} {
+			count, size := info.Messages(d)
+			attrs = append(attrs, attribute.Int64("proxy.messages."+d.String(), count), attribute.Int64("proxy.bytes."+d.String(), size))
+		}
+		span.SetAttributes(attrs...)
+		endSpan(span, err)
+	})
+	return ctx
+}
+
+// startDirector starts the span of a call of the StreamDirector, returning the function ending it.
+func (t *Tracing) startDirector(ctx context.Context) (context.Context, func(err error)) {
+	ctx, span := t.tracer.Start(ctx, "proxy.director", trace.WithSpanKind(trace.SpanKindInternal))
+	return ctx, func(err error) {
+		if info, ok := StreamInfoFromContext(ctx); ok && info.Backend() != "" {
+			span.SetAttributes(attribute.String("proxy.backend", info.Backend()))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		endSpan(span, err)
+	}
+}
+
+// startBackend starts the span of a stream opened to a backend as a child of the span in ctx, and injects its context
+// into the metadata of outgoingCtx. It returns the new outgoing context and the function ending the span.
+func (t *Tracing) startBackend(ctx, outgoingCtx context.Context, fullMethodName string, cc grpc.ClientConnInterface) (context.Context, func(err error)) {
+	attrs := rpcAttributes(fullMethodName)
+	if info, ok := StreamInfoFromContext(ctx); ok && info.Backend() != "" {
+		attrs = append(attrs, attribute.String("proxy.backend", info.Backend()))
+	}
+	if conn, ok := cc.(interface{ Target() string }); ok {
+		attrs = append(attrs, attribute.String("net.peer.name", conn.Target()))
+	}
+	ctx, span := t.tracer.Start(ctx, strings.TrimPrefix(fullMethodName, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+
+	md, _ := metadata.FromOutgoingContext(outgoingCtx)
+	md = md.Copy()
+	// The trace context of the client, copied by the director, must not reach the backend alongside the new one.
+	for _, field := range t.propagator.Fields() {
+		delete(md, strings.ToLower(field))
+	}
+	t.propagator.Inject(ctx, metadataCarrier(md))
+	outgoingCtx = metadata.NewOutgoingContext(trace.ContextWithSpan(outgoingCtx, span), md)
+	return outgoingCtx, func(err error) { endSpan(span, err) }
+}
@@ -0,0 +1,104 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/mwitkow/grpc-proxy/testservice"
+)
+
+const (
+	clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID  = "00f067aa0ba902b7"
+)
+
+// recordedTracing returns the option tracing calls to the returned recorder.
+func recordedTracing() (proxy.HandlerOption, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing := proxy.NewTracing(proxy.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+	return proxy.WithTracing(tracing), recorder
+}
+
+// spansByKind returns the ended spans of recorder by kind.
+func spansByKind(recorder *tracetest.SpanRecorder) map[trace.SpanKind]sdktrace.ReadOnlySpan {
+	spans := make(map[trace.SpanKind]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.SpanKind()] = s
+	}
+	return spans
+}
+
+func spanAttributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing_Spans(t *testing.T) {
+	tracing, recorder := recordedTracing()
+	client := balancedTestClient(t, nil, tracing)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-01")
+	header := metadata.MD{}
+	_, err := client.Ping(ctx, &testservice.PingRequest{Value: "hello"}, grpc.Header(&header))
+	require.NoError(t, err)
+
+	require.Len(t, recorder.Ended(), 3)
+	spans := spansByKind(recorder)
+	server, director, backend := spans[trace.SpanKindServer], spans[trace.SpanKindInternal], spans[trace.SpanKindClient]
+	require.NotNil(t, server)
+	require.NotNil(t, director)
+	require.NotNil(t, backend)
+	assert.Equal(t, "mwitkow.testproto.TestService/Ping", server.Name())
+	assert.Equal(t, "proxy.director", director.Name())
+	assert.Equal(t, "mwitkow.testproto.TestService/Ping", backend.Name())
+
+	assert.Equal(t, clientTraceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, clientSpanID, server.Parent().SpanID().String())
+	assert.True(t, server.Parent().IsRemote())
+	assert.Equal(t, server.SpanContext().SpanID(), director.Parent().SpanID())
+	assert.Equal(t, server.SpanContext().SpanID(), backend.Parent().SpanID())
+
+	// The test service echoes the metadata it received, which carries the context of the backend span.
+	want := "00-" + clientTraceID + "-" + backend.SpanContext().SpanID().String() + "-01"
+	assert.Equal(t, []string{want}, header.Get("traceparent"))
+	assert.Equal(t, []string{clientTraceID + "-" + backend.SpanContext().SpanID().String() + "-1"}, header.Get("b3"))
+
+	attrs := spanAttributes(server)
+	assert.Equal(t, "backend", attrs["proxy.backend"].AsString())
+	assert.Equal(t, "mwitkow.testproto.TestService", attrs["rpc.service"].AsString())
+	assert.Equal(t, "Ping", attrs["rpc.method"].AsString())
+	assert.EqualValues(t, 0, attrs["rpc.grpc.status_code"].AsInt64())
+	assert.EqualValues(t, 1, attrs["proxy.messages.client_to_backend"].AsInt64())
+	assert.EqualValues(t, 7, attrs["proxy.bytes.backend_to_client"].AsInt64())
+	assert.Equal(t, "backend", spanAttributes(director)["proxy.backend"].AsString())
+	assert.Equal(t, "bufnet", spanAttributes(backend)["net.peer.name"].AsString())
+}
+
+func TestTracing_B3AndErrors(t *testing.T) {
+	tracing, recorder := recordedTracing()
+	client := proxyTestClient(t, nil, tracing)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "b3", clientTraceID+"-"+clientSpanID+"-1")
+	_, err := client.PingError(ctx, &testservice.PingRequest{Value: "hello"})
+	require.Error(t, err)
+
+	server := spansByKind(recorder)[trace.SpanKindServer]
+	require.NotNil(t, server)
+	assert.Equal(t, clientTraceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, otelcodes.Error, server.Status().Code)
+	assert.EqualValues(t, 2, spanAttributes(server)["rpc.grpc.status_code"].AsInt64())
+}